@@ -0,0 +1,218 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"jp/app/db"
+	"net/http"
+	"time"
+)
+
+type APIKey = db.APIKey
+
+// Scopes say what an api key may do, each route needs one of them
+const (
+	ScopeDinosaursRead  = "dinosaurs:read"
+	ScopeDinosaursWrite = "dinosaurs:write"
+	ScopeCagesRead      = "cages:read"
+	ScopeCagesWrite     = "cages:write"
+	ScopeSpeciesRead    = "species:read"
+	ScopeSpeciesWrite   = "species:write"
+	ScopeAuditRead      = "audit:read"
+	ScopeEventsRead     = "events:read"
+)
+
+const (
+	// apiKeyPrefix starts every key so a leaked one is easy to recognise
+	apiKeyPrefix = "jpk_"
+	// apiKeyTouchInterval is how stale last_used_at can get, so a busy key is not written on every request
+	apiKeyTouchInterval = time.Minute
+)
+
+// NewAPIKey holds the name and scopes of a key to mint
+type NewAPIKey struct {
+	Name   string   `json:"name" validate:"required"`
+	Scopes []string `json:"scopes" validate:"required,min=1,dive,oneof=dinosaurs:read dinosaurs:write cages:read cages:write species:read species:write audit:read events:read"`
+}
+
+// APIKeyScopes replaces the scopes of a key
+type APIKeyScopes struct {
+	Scopes []string `json:"scopes" validate:"required,min=1,dive,oneof=dinosaurs:read dinosaurs:write cages:read cages:write species:read species:write audit:read events:read"`
+}
+
+// MintedAPIKey is a new key along with the key itself, which is never shown again
+type MintedAPIKey struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+// CreateAPIKey mints a new api key
+func (s dinoServiceImpl) CreateAPIKey(ctx context.Context, key NewAPIKey) (MintedAPIKey, error) {
+
+	v := newValidator()
+	err := v.Struct(key)
+	if err != nil {
+		return MintedAPIKey{}, validationFailed(err)
+	}
+
+	secret := make([]byte, 32)
+	_, err = rand.Read(secret)
+	if err != nil {
+		return MintedAPIKey{}, err
+	}
+	minted := MintedAPIKey{Key: apiKeyPrefix + base64.RawURLEncoding.EncodeToString(secret)}
+
+	err = s.dbService.InTx(ctx, func(repos db.Repositories) error {
+		id, err := repos.APIKeys().Create(ctx, APIKey{
+			Name:   key.Name,
+			Prefix: minted.Key[:len(apiKeyPrefix)+8],
+			Hash:   hashAPIKey(minted.Key),
+			Scopes: key.Scopes,
+		})
+		if err != nil {
+			return err
+		}
+		minted.APIKey, err = repos.APIKeys().Get(ctx, id)
+		if err != nil {
+			return err
+		}
+		return audit(ctx, repos, AuditCreate, AuditEntityAPIKey, id, nil, minted.APIKey)
+	})
+	if err != nil {
+		return MintedAPIKey{}, err
+	}
+	return minted, nil
+}
+
+// GetAPIKeys get a page of the api keys, revoked ones included
+func (s dinoServiceImpl) GetAPIKeys(ctx context.Context, page PageRequest) (Page[APIKey], error) {
+	afterId, err := validatePageRequest(page)
+	if err != nil {
+		return Page[APIKey]{}, err
+	}
+	keys, err := s.dbService.APIKeys().List(ctx, db.APIKeyFilter{AfterId: afterId, Limit: page.limit() + 1})
+	if err != nil {
+		return Page[APIKey]{}, err
+	}
+	return newPage(keys, page.limit(), func(k APIKey) int64 { return k.Id }), nil
+}
+
+// UpdateAPIKeyScopes replaces the scopes of an api key, returning the key as stored
+func (s dinoServiceImpl) UpdateAPIKeyScopes(ctx context.Context, keyId int64, scopes APIKeyScopes) (APIKey, error) {
+
+	v := newValidator()
+	err := v.Struct(scopes)
+	if err != nil {
+		return APIKey{}, validationFailed(err)
+	}
+
+	var updated APIKey
+	err = s.dbService.InTx(ctx, func(repos db.Repositories) error {
+		current, err := repos.APIKeys().Get(ctx, keyId)
+		if err != nil {
+			return err
+		}
+		err = repos.APIKeys().UpdateScopes(ctx, keyId, scopes.Scopes)
+		if err != nil {
+			return err
+		}
+		updated, err = repos.APIKeys().Get(ctx, keyId)
+		if err != nil {
+			return err
+		}
+		return audit(ctx, repos, AuditUpdate, AuditEntityAPIKey, keyId, current, updated)
+	})
+	if err != nil {
+		return APIKey{}, err
+	}
+	return updated, nil
+}
+
+// RevokeAPIKey stops an api key from being used, the key is kept on record
+func (s dinoServiceImpl) RevokeAPIKey(ctx context.Context, keyId int64) error {
+	return s.dbService.InTx(ctx, func(repos db.Repositories) error {
+		current, err := repos.APIKeys().Get(ctx, keyId)
+		if err != nil {
+			return err
+		}
+		if current.RevokedAt != nil {
+			return nil
+		}
+		err = repos.APIKeys().Revoke(ctx, keyId)
+		if err != nil {
+			return err
+		}
+		revoked, err := repos.APIKeys().Get(ctx, keyId)
+		if err != nil {
+			return err
+		}
+		return audit(ctx, repos, AuditRevoke, AuditEntityAPIKey, keyId, current, revoked)
+	})
+}
+
+// AuthenticateAPIKey returns the live api key matching key and records that it was used
+func (s dinoServiceImpl) AuthenticateAPIKey(ctx context.Context, key string) (APIKey, error) {
+	apiKey, err := s.dbService.APIKeys().GetByHash(ctx, hashAPIKey(key))
+	if errors.Is(err, sql.ErrNoRows) {
+		return APIKey{}, fmt.Errorf("%w: unknown api key", errUnauthenticated)
+	}
+	if err != nil {
+		return APIKey{}, err
+	}
+	if apiKey.RevokedAt != nil {
+		return APIKey{}, fmt.Errorf("%w: api key %s is revoked", errUnauthenticated, apiKey.Prefix)
+	}
+
+	now := time.Now().UTC()
+	if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) >= apiKeyTouchInterval {
+		err = s.dbService.APIKeys().Touch(ctx, apiKey.Id, now)
+		if err != nil {
+			return APIKey{}, err
+		}
+		apiKey.LastUsedAt = &now
+	}
+	return apiKey, nil
+}
+
+// hashAPIKey is all that is stored of a key, the keys are random enough that a plain sha256 cannot be reversed
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// APIKeyStore looks up the api keys clients authenticate with
+type APIKeyStore interface {
+	AuthenticateAPIKey(ctx context.Context, key string) (APIKey, error)
+}
+
+// APIKeyAuthenticator accepts an api key in the X-API-Key header, requests without one are passed on to next
+type APIKeyAuthenticator struct {
+	keys APIKeyStore
+	next Authenticator
+}
+
+func NewAPIKeyAuthenticator(keys APIKeyStore, next Authenticator) APIKeyAuthenticator {
+	return APIKeyAuthenticator{keys: keys, next: next}
+}
+
+func (a APIKeyAuthenticator) Authenticate(r *http.Request) (Principal, error) {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		return a.next.Authenticate(r)
+	}
+	apiKey, err := a.keys.AuthenticateAPIKey(r.Context(), key)
+	if err != nil {
+		return Principal{}, err
+	}
+	// an api key has scopes instead of a role
+	return Principal{
+		Subject: fmt.Sprintf("api_key:%d:%s", apiKey.Id, apiKey.Name),
+		Scopes:  apiKey.Scopes,
+	}, nil
+}
@@ -0,0 +1,101 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"jp/app/db"
+	"time"
+)
+
+type AuditEvent = db.AuditEvent
+
+const (
+	AuditCreate  = "create"
+	AuditUpdate  = "update"
+	AuditDelete  = "delete"
+	AuditArchive = "archive"
+	AuditRevoke  = "revoke"
+
+	AuditEntityDinosaur = "dinosaur"
+	AuditEntityCage     = "cage"
+	AuditEntitySpecies  = "species"
+	AuditEntityAPIKey   = "api_key"
+)
+
+// unknownActor is recorded for changes made without anyone named in the context
+const unknownActor = "unknown"
+
+// AuditFilter holds the query parameters of GET /audit, To must come after From when both are given
+type AuditFilter struct {
+	Entity   string `validate:"omitempty,oneof=dinosaur cage species api_key"`
+	EntityId int64
+	From     time.Time
+	To       time.Time `validate:"omitempty,gtfield=From"`
+}
+
+type actorKey struct{}
+
+// WithActor names who is making the changes done with ctx, for the audit log
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+func actorFrom(ctx context.Context) string {
+	actor, ok := ctx.Value(actorKey{}).(string)
+	if !ok || actor == "" {
+		return unknownActor
+	}
+	return actor
+}
+
+// audit appends an event to the audit log in the transaction of the change it records,
+// before is nil for a create and after is nil for a delete
+func audit(ctx context.Context, repos db.Repositories, action string, entity string, entityId int64, before any, after any) error {
+	event := AuditEvent{
+		Actor:    actorFrom(ctx),
+		Action:   action,
+		Entity:   entity,
+		EntityId: entityId,
+	}
+	var err error
+	if before != nil {
+		event.Before, err = json.Marshal(before)
+		if err != nil {
+			return err
+		}
+	}
+	if after != nil {
+		event.After, err = json.Marshal(after)
+		if err != nil {
+			return err
+		}
+	}
+	return repos.Audit().Append(ctx, event)
+}
+
+// GetAuditEvents get a page of the audit log matching the filter, oldest first
+func (s dinoServiceImpl) GetAuditEvents(ctx context.Context, filter AuditFilter, page PageRequest) (Page[AuditEvent], error) {
+	afterId, err := validatePageRequest(page)
+	if err != nil {
+		return Page[AuditEvent]{}, err
+	}
+
+	v := newValidator()
+	err = v.Struct(filter)
+	if err != nil {
+		return Page[AuditEvent]{}, validationFailed(err)
+	}
+
+	events, err := s.dbService.Audit().List(ctx, db.AuditFilter{
+		Entity:   filter.Entity,
+		EntityId: filter.EntityId,
+		From:     filter.From,
+		To:       filter.To,
+		AfterId:  afterId,
+		Limit:    page.limit() + 1,
+	})
+	if err != nil {
+		return Page[AuditEvent]{}, err
+	}
+	return newPage(events, page.limit(), func(e AuditEvent) int64 { return e.Id }), nil
+}
@@ -0,0 +1,202 @@
+package app
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/go-chi/render"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog"
+)
+
+// Role is what a caller is allowed to do, each role can do everything the roles before it can
+type Role string
+
+const (
+	// RoleViewer can only read
+	RoleViewer Role = "viewer"
+	// RoleKeeper can also add and move dinosaurs
+	RoleKeeper Role = "keeper"
+	// RoleAdmin can also create and alter cages and species and delete anything
+	RoleAdmin Role = "admin"
+)
+
+var roleRank = map[Role]int{
+	RoleViewer: 1,
+	RoleKeeper: 2,
+	RoleAdmin:  3,
+}
+
+// allows reports whether the role can do what the required role can
+func (r Role) allows(required Role) bool {
+	return roleRank[r] >= roleRank[required]
+}
+
+// Principal is who a request is made by, a user has a role and an api key has scopes
+type Principal struct {
+	Subject string
+	Role    Role
+	Scopes  []string
+}
+
+// can reports whether the principal has the role, or the scope, a route needs
+func (p Principal) can(role Role, scope string) bool {
+	return p.Role.allows(role) || (scope != "" && slices.Contains(p.Scopes, scope))
+}
+
+// errUnauthenticated is returned by an Authenticator when a request carries no valid credentials
+var errUnauthenticated = errors.New("unauthenticated")
+
+// Authenticator works out who made a request, returning an error wrapping errUnauthenticated when it cannot
+type Authenticator interface {
+	Authenticate(r *http.Request) (Principal, error)
+}
+
+// OpenAccess lets every request through as an admin, for local runs and tests only.
+// The actor in the audit log is taken from the X-Actor header.
+type OpenAccess struct{}
+
+func (OpenAccess) Authenticate(r *http.Request) (Principal, error) {
+	return Principal{Subject: r.Header.Get("X-Actor"), Role: RoleAdmin}, nil
+}
+
+// JWTConfig holds the keys bearer tokens are checked with, at least one key must be set
+type JWTConfig struct {
+	// HS256Secret checks tokens signed with HS256
+	HS256Secret []byte
+	// RS256PublicKey checks tokens signed with RS256
+	RS256PublicKey *rsa.PublicKey
+	// Issuer and Audience are checked when they are set
+	Issuer   string
+	Audience string
+}
+
+// JWTAuthenticator accepts bearer tokens carrying a subject, an expiry and a role claim
+type JWTAuthenticator struct {
+	config JWTConfig
+	parser *jwt.Parser
+}
+
+type jwtClaims struct {
+	Role Role `json:"role"`
+	jwt.RegisteredClaims
+}
+
+func NewJWTAuthenticator(config JWTConfig) (*JWTAuthenticator, error) {
+	methods := []string{}
+	if len(config.HS256Secret) > 0 {
+		methods = append(methods, jwt.SigningMethodHS256.Alg())
+	}
+	if config.RS256PublicKey != nil {
+		methods = append(methods, jwt.SigningMethodRS256.Alg())
+	}
+	if len(methods) == 0 {
+		return nil, errors.New("no key configured for checking tokens")
+	}
+
+	options := []jwt.ParserOption{jwt.WithValidMethods(methods), jwt.WithExpirationRequired()}
+	if config.Issuer != "" {
+		options = append(options, jwt.WithIssuer(config.Issuer))
+	}
+	if config.Audience != "" {
+		options = append(options, jwt.WithAudience(config.Audience))
+	}
+	return &JWTAuthenticator{config: config, parser: jwt.NewParser(options...)}, nil
+}
+
+func (a *JWTAuthenticator) Authenticate(r *http.Request) (Principal, error) {
+	header := r.Header.Get("Authorization")
+	token, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok || token == "" {
+		return Principal{}, fmt.Errorf("%w: no bearer token", errUnauthenticated)
+	}
+
+	claims := jwtClaims{}
+	_, err := a.parser.ParseWithClaims(token, &claims, a.key)
+	if err != nil {
+		return Principal{}, fmt.Errorf("%w: %v", errUnauthenticated, err)
+	}
+	if claims.Subject == "" {
+		return Principal{}, fmt.Errorf("%w: token has no subject", errUnauthenticated)
+	}
+	if _, ok := roleRank[claims.Role]; !ok {
+		return Principal{}, fmt.Errorf("%w: unknown role %q", errUnauthenticated, claims.Role)
+	}
+	return Principal{Subject: claims.Subject, Role: claims.Role}, nil
+}
+
+// key picks the key matching the signing method, which the parser has already checked is allowed
+func (a *JWTAuthenticator) key(token *jwt.Token) (any, error) {
+	switch token.Method.Alg() {
+	case jwt.SigningMethodHS256.Alg():
+		return a.config.HS256Secret, nil
+	case jwt.SigningMethodRS256.Alg():
+		return a.config.RS256PublicKey, nil
+	}
+	return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+}
+
+type principalKey struct{}
+
+// principalFrom returns who made the request, set by authenticate
+func principalFrom(ctx context.Context) (Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(Principal)
+	return principal, ok
+}
+
+// authenticate rejects requests without valid credentials with a 401, the caller is recorded
+// as the actor of any change the request makes
+func authenticate(auth Authenticator, logger *zerolog.Logger) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal, err := auth.Authenticate(r)
+			if err != nil {
+				logger.Error().Err(err).Msg("error authenticating request")
+				if !errors.Is(err, errUnauthenticated) {
+					err := render.Render(w, r, ServerError(errors.New("server error")))
+					if err != nil {
+						logger.Error().Err(err).Msg("render error")
+					}
+					return
+				}
+				w.Header().Set("WWW-Authenticate", `Bearer realm="jp"`)
+				err := render.Render(w, r, Unauthorized(errors.New("a valid bearer token or api key is required")))
+				if err != nil {
+					logger.Error().Err(err).Msg("render error")
+				}
+				return
+			}
+			ctx := context.WithValue(r.Context(), principalKey{}, principal)
+			ctx = WithActor(ctx, principal.Subject)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// authorize rejects requests from callers with neither the role nor the scope with a 403,
+// an empty scope keeps a route to users with the role
+func authorize(role Role, scope string, logger *zerolog.Logger) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal, ok := principalFrom(r.Context())
+			if !ok || !principal.can(role, scope) {
+				logger.Error().Str("subject", principal.Subject).Str("role", string(principal.Role)).Msg("forbidden")
+				message := fmt.Sprintf("the %s role is required", role)
+				if scope != "" {
+					message = fmt.Sprintf("the %s role or the %s scope is required", role, scope)
+				}
+				err := render.Render(w, r, Forbidden(errors.New(message)))
+				if err != nil {
+					logger.Error().Err(err).Msg("render error")
+				}
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
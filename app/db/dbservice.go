@@ -1,15 +1,138 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
+	"time"
 
 	_ "github.com/lib/pq"
 )
 
+// ErrReferenced is returned when a row cannot be deleted because other rows point at it
+var ErrReferenced = errors.New("row is still referenced")
+
+// ErrDuplicate is returned when a write would break a unique constraint
+var ErrDuplicate = errors.New("row already exists")
+
+// ErrMissingReference is returned when a write points at a row that does not exist
+var ErrMissingReference = errors.New("referenced row does not exist")
+
+// Every Update, Delete and Archive returns sql.ErrNoRows when no row matched,
+// Create and Update return ErrDuplicate and ErrMissingReference
+
+// DbService is the storage behind the DinoService
 type DbService interface {
-	GetConnection() *sql.DB
+	Repositories
+	// InTx runs fn against repositories bound to a single transaction, committing only if fn succeeds
+	InTx(ctx context.Context, fn func(repos Repositories) error) error
+	Close() error
+}
+
+type Repositories interface {
+	Dinos() DinoRepository
+	Cages() CageRepository
+	Species() SpeciesRepository
+	Audit() AuditRepository
+	Placements() PlacementRepository
+	APIKeys() APIKeyRepository
+	Idempotency() IdempotencyRepository
+	Events() EventRepository
+}
+
+type DinoRepository interface {
+	List(ctx context.Context, filter DinoFilter) ([]Dinosaur, error)
+	Get(ctx context.Context, dinoId int64) (Dinosaur, error)
+	// GetForUpdate reads a dino and locks it until the surrounding transaction ends
+	GetForUpdate(ctx context.Context, dinoId int64) (Dinosaur, error)
+	// ListByCage returns an empty slice, not sql.ErrNoRows, for an empty cage
+	ListByCage(ctx context.Context, cageId int64) ([]Dinosaur, error)
+	// Create returns the id of the new dino
+	Create(ctx context.Context, dino Dinosaur) (int64, error)
+	Update(ctx context.Context, dino Dinosaur) error
+	Delete(ctx context.Context, dinoId int64) error
+	// Archive hides a dino from every read while keeping its row for history
+	Archive(ctx context.Context, dinoId int64) error
+}
+
+type CageRepository interface {
+	List(ctx context.Context, filter CageFilter) ([]Cage, error)
+	Get(ctx context.Context, cageId int64) (Cage, error)
+	// GetForUpdate reads a cage and locks it until the surrounding transaction ends
+	GetForUpdate(ctx context.Context, cageId int64) (Cage, error)
+	// Create returns the id of the new cage
+	Create(ctx context.Context, cage Cage) (int64, error)
+	Update(ctx context.Context, cage Cage) error
+	// Delete returns ErrReferenced while any dino row, archived or not, points at the cage
+	Delete(ctx context.Context, cageId int64) error
+	// Archive hides a cage from every read while keeping its row for history
+	Archive(ctx context.Context, cageId int64) error
+}
+
+type SpeciesRepository interface {
+	List(ctx context.Context, filter SpeciesFilter) ([]Species, error)
+	GetByName(ctx context.Context, name string) (Species, error)
+	Create(ctx context.Context, species Species) error
+	// Update changes the diet of the species with the given name
+	Update(ctx context.Context, species Species) error
+	// Delete returns ErrReferenced while any dino row, archived or not, is of the species
+	Delete(ctx context.Context, name string) error
+}
+
+// AuditRepository is append only, events are never changed or removed
+type AuditRepository interface {
+	Append(ctx context.Context, event AuditEvent) error
+	List(ctx context.Context, filter AuditFilter) ([]AuditEvent, error)
+}
+
+// PlacementRepository keeps the history of which cage each dino was in and when
+type PlacementRepository interface {
+	// Move ends the placement the dino is in, if any, and starts one in the cage at the same instant
+	Move(ctx context.Context, dinoId int64, cageId int64) error
+	// End ends the placement of a dino leaving the park
+	End(ctx context.Context, dinoId int64) error
+	ListByDino(ctx context.Context, dinoId int64, filter PlacementFilter) ([]DinoPlacement, error)
+	// ListByCageAt returns the placements in the cage that had started and not yet ended at the given time
+	ListByCageAt(ctx context.Context, cageId int64, at time.Time) ([]DinoPlacement, error)
+}
+
+type APIKeyRepository interface {
+	// Create returns the id of the new key
+	Create(ctx context.Context, key APIKey) (int64, error)
+	// List includes revoked keys
+	List(ctx context.Context, filter APIKeyFilter) ([]APIKey, error)
+	Get(ctx context.Context, keyId int64) (APIKey, error)
+	GetByHash(ctx context.Context, hash string) (APIKey, error)
+	UpdateScopes(ctx context.Context, keyId int64, scopes []string) error
+	Revoke(ctx context.Context, keyId int64) error
+	// Touch records that the key was used at the given time
+	Touch(ctx context.Context, keyId int64, at time.Time) error
+}
+
+// EventRepository is the log behind the event stream, events are only ever appended and a
+// reader that has seen every id up to some event never misses one committed after it
+type EventRepository interface {
+	Append(ctx context.Context, event ParkEvent) error
+	List(ctx context.Context, filter ParkEventFilter) ([]ParkEvent, error)
+	// LastId is 0 while the log is empty
+	LastId(ctx context.Context) (int64, error)
+}
+
+// IdempotencyRepository keeps the first response to each idempotency key, the caller passes the time
+// so expired requests are treated as missing
+type IdempotencyRepository interface {
+	// Reserve records a request before it is handled, returning ErrDuplicate while an unexpired request
+	// holds the key. An expired request is replaced.
+	Reserve(ctx context.Context, request IdempotentRequest, now time.Time) error
+	Get(ctx context.Context, subject string, key string, now time.Time) (IdempotentRequest, error)
+	// Complete stores the status, header and body of the response to a reserved request along with its new expiry
+	Complete(ctx context.Context, request IdempotentRequest) error
+	// Release removes a request that was never answered, so it can be sent again
+	Release(ctx context.Context, subject string, key string) error
+	// DeleteExpired returns the number of requests removed
+	DeleteExpired(ctx context.Context, now time.Time) (int64, error)
 }
 
 type Database struct {
@@ -20,10 +143,65 @@ func (db Database) GetConnection() *sql.DB {
 	return db.Conn
 }
 
+func (db Database) Dinos() DinoRepository {
+	return postgresDinoRepository{q: db.Conn}
+}
+
+func (db Database) Cages() CageRepository {
+	return postgresCageRepository{q: db.Conn}
+}
+
+func (db Database) Species() SpeciesRepository {
+	return postgresSpeciesRepository{q: db.Conn}
+}
+
+func (db Database) Audit() AuditRepository {
+	return postgresAuditRepository{q: db.Conn}
+}
+
+func (db Database) Placements() PlacementRepository {
+	return postgresPlacementRepository{q: db.Conn}
+}
+
+func (db Database) APIKeys() APIKeyRepository {
+	return postgresAPIKeyRepository{q: db.Conn}
+}
+
+func (db Database) Idempotency() IdempotencyRepository {
+	return postgresIdempotencyRepository{q: db.Conn}
+}
+
+func (db Database) Events() EventRepository {
+	return postgresEventRepository{q: db.Conn}
+}
+
+func (db Database) InTx(ctx context.Context, fn func(repos Repositories) error) error {
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = fn(postgresTx{tx: tx})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db Database) Close() error {
+	return db.Conn.Close()
+}
+
 func NewDbService(host, username, password, database, port string) (DbService, error) {
-	db := Database{}
 	ds := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
 		host, port, username, password, database)
+	return OpenDbService(ds)
+}
+
+// OpenDbService connects to the postgres database named by a connection string
+func OpenDbService(ds string) (DbService, error) {
+	db := Database{}
 	conn, err := sql.Open("postgres", ds)
 	if err != nil {
 		return db, err
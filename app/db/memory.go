@@ -0,0 +1,906 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// memoryData is one copy of everything the memory store holds
+type memoryData struct {
+	dinos         map[int64]Dinosaur
+	cages         map[int64]Cage
+	species       map[int64]Species
+	nextDinoId    int64
+	nextCageId    int64
+	nextSpeciesId int64
+	// archived rows are moved out of dinos and cages so reads never see them
+	archivedDinos map[int64]Dinosaur
+	archivedCages map[int64]Cage
+	// audit is only ever appended to, in id order
+	audit []AuditEvent
+	// placements are in id order, the id of a placement is its index plus one
+	placements []DinoPlacement
+	apiKeys    map[int64]APIKey
+	nextKeyId  int64
+	// events are only ever appended to, in id order
+	events []ParkEvent
+	// idempotency is keyed by subject and key
+	idempotency map[[2]string]IdempotentRequest
+}
+
+func (d *memoryData) clone() *memoryData {
+	return &memoryData{
+		dinos:         maps.Clone(d.dinos),
+		cages:         maps.Clone(d.cages),
+		species:       maps.Clone(d.species),
+		nextDinoId:    d.nextDinoId,
+		nextCageId:    d.nextCageId,
+		nextSpeciesId: d.nextSpeciesId,
+		archivedDinos: maps.Clone(d.archivedDinos),
+		archivedCages: maps.Clone(d.archivedCages),
+		audit:         slices.Clip(d.audit),
+		placements:    slices.Clone(d.placements),
+		apiKeys:       maps.Clone(d.apiKeys),
+		nextKeyId:     d.nextKeyId,
+		events:        slices.Clip(d.events),
+		idempotency:   maps.Clone(d.idempotency),
+	}
+}
+
+// memoryAccess hands out memoryData for reading or writing
+type memoryAccess interface {
+	read(fn func(d *memoryData) error) error
+	write(fn func(d *memoryData) error) error
+}
+
+// MemoryStore is a thread safe DbService that keeps everything in process, for tests and demos.
+// Transactions are serialised and work on a copy of the data which replaces the original on commit.
+type MemoryStore struct {
+	// txMu serialises writers, mu guards data for readers
+	txMu sync.Mutex
+	mu   sync.RWMutex
+	data *memoryData
+}
+
+// NewMemoryService returns a MemoryStore holding the same seed data as sql/create_tables.sql
+func NewMemoryService() *MemoryStore {
+	store := &MemoryStore{
+		data: &memoryData{
+			dinos:         map[int64]Dinosaur{},
+			cages:         map[int64]Cage{},
+			species:       map[int64]Species{},
+			nextDinoId:    1,
+			nextCageId:    1,
+			nextSpeciesId: 1,
+			archivedDinos: map[int64]Dinosaur{},
+			archivedCages: map[int64]Cage{},
+			apiKeys:       map[int64]APIKey{},
+			nextKeyId:     1,
+			idempotency:   map[[2]string]IdempotentRequest{},
+		},
+	}
+	ctx := context.Background()
+	seedSpecies := []Species{
+		{Name: "Tyrannosaurus", Diet: "carnivore"},
+		{Name: "Velociraptor", Diet: "carnivore"},
+		{Name: "Spinosaurus", Diet: "carnivore"},
+		{Name: "Megalosaurus", Diet: "carnivore"},
+		{Name: "Brachiosaurus", Diet: "herbivore"},
+		{Name: "Stegosaurus", Diet: "herbivore"},
+		{Name: "Ankylosaurus", Diet: "herbivore"},
+		{Name: "Triceratops", Diet: "herbivore"},
+	}
+	for _, species := range seedSpecies {
+		store.Species().Create(ctx, species)
+	}
+	seedCages := []Cage{
+		{Name: "Cage One", Status: "ACTIVE", MaxCapacity: 4},
+		{Name: "Cage Two", Status: "ACTIVE", MaxCapacity: 6},
+	}
+	for _, cage := range seedCages {
+		store.Cages().Create(ctx, cage)
+	}
+	seedDinos := []Dinosaur{
+		{Name: "Maggie", Species: "Tyrannosaurus", CageId: 1},
+		{Name: "Lisa", Species: "Tyrannosaurus", CageId: 1},
+		{Name: "Bart", Species: "Brachiosaurus", CageId: 2},
+		{Name: "Homer", Species: "Stegosaurus", CageId: 2},
+		{Name: "Marge", Species: "Ankylosaurus", CageId: 2},
+	}
+	for _, dino := range seedDinos {
+		id, _ := store.Dinos().Create(ctx, dino)
+		store.Placements().Move(ctx, id, dino.CageId)
+	}
+	return store
+}
+
+func (s *MemoryStore) Dinos() DinoRepository {
+	return memoryDinoRepository{a: s}
+}
+
+func (s *MemoryStore) Cages() CageRepository {
+	return memoryCageRepository{a: s}
+}
+
+func (s *MemoryStore) Species() SpeciesRepository {
+	return memorySpeciesRepository{a: s}
+}
+
+func (s *MemoryStore) Audit() AuditRepository {
+	return memoryAuditRepository{a: s}
+}
+
+func (s *MemoryStore) Placements() PlacementRepository {
+	return memoryPlacementRepository{a: s}
+}
+
+func (s *MemoryStore) APIKeys() APIKeyRepository {
+	return memoryAPIKeyRepository{a: s}
+}
+
+func (s *MemoryStore) Idempotency() IdempotencyRepository {
+	return memoryIdempotencyRepository{a: s}
+}
+
+func (s *MemoryStore) Events() EventRepository {
+	return memoryEventRepository{a: s}
+}
+
+func (s *MemoryStore) InTx(ctx context.Context, fn func(repos Repositories) error) error {
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+
+	s.mu.RLock()
+	tx := &memoryTx{data: s.data.clone()}
+	s.mu.RUnlock()
+
+	err := fn(tx)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.data = tx.data
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+func (s *MemoryStore) read(fn func(d *memoryData) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return fn(s.data)
+}
+
+// write runs outside of InTx still wait for any open transaction so its commit cannot overwrite them
+func (s *MemoryStore) write(fn func(d *memoryData) error) error {
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fn(s.data)
+}
+
+// memoryTx owns its copy of the data so it needs no locking
+type memoryTx struct {
+	data *memoryData
+}
+
+func (t *memoryTx) Dinos() DinoRepository {
+	return memoryDinoRepository{a: t}
+}
+
+func (t *memoryTx) Cages() CageRepository {
+	return memoryCageRepository{a: t}
+}
+
+func (t *memoryTx) Species() SpeciesRepository {
+	return memorySpeciesRepository{a: t}
+}
+
+func (t *memoryTx) Audit() AuditRepository {
+	return memoryAuditRepository{a: t}
+}
+
+func (t *memoryTx) Placements() PlacementRepository {
+	return memoryPlacementRepository{a: t}
+}
+
+func (t *memoryTx) APIKeys() APIKeyRepository {
+	return memoryAPIKeyRepository{a: t}
+}
+
+func (t *memoryTx) Idempotency() IdempotencyRepository {
+	return memoryIdempotencyRepository{a: t}
+}
+
+func (t *memoryTx) Events() EventRepository {
+	return memoryEventRepository{a: t}
+}
+
+func (t *memoryTx) read(fn func(d *memoryData) error) error {
+	return fn(t.data)
+}
+
+func (t *memoryTx) write(fn func(d *memoryData) error) error {
+	return fn(t.data)
+}
+
+type memoryDinoRepository struct {
+	a memoryAccess
+}
+
+func (r memoryDinoRepository) List(ctx context.Context, filter DinoFilter) ([]Dinosaur, error) {
+	diets := map[string]string{}
+	r.a.read(func(d *memoryData) error {
+		for _, species := range d.species {
+			diets[species.Name] = species.Diet
+		}
+		return nil
+	})
+	dinos, err := r.filter(func(dino Dinosaur) bool {
+		if filter.CageId != 0 && dino.CageId != filter.CageId {
+			return false
+		}
+		if dino.Id <= filter.AfterId {
+			return false
+		}
+		if filter.Species != "" && dino.Species != filter.Species {
+			return false
+		}
+		return filter.Diet == "" || diets[dino.Species] == filter.Diet
+	})
+	if filter.Limit > 0 && len(dinos) > filter.Limit {
+		dinos = dinos[:filter.Limit]
+	}
+	return dinos, err
+}
+
+func (r memoryDinoRepository) Get(ctx context.Context, dinoId int64) (Dinosaur, error) {
+	var dino Dinosaur
+	err := r.a.read(func(d *memoryData) error {
+		found, ok := d.dinos[dinoId]
+		if !ok {
+			return sql.ErrNoRows
+		}
+		dino = found
+		return nil
+	})
+	return dino, err
+}
+
+// GetForUpdate needs no lock of its own, transactions are already serialised
+func (r memoryDinoRepository) GetForUpdate(ctx context.Context, dinoId int64) (Dinosaur, error) {
+	return r.Get(ctx, dinoId)
+}
+
+func (r memoryDinoRepository) ListByCage(ctx context.Context, cageId int64) ([]Dinosaur, error) {
+	return r.filter(func(dino Dinosaur) bool { return dino.CageId == cageId })
+}
+
+func (r memoryDinoRepository) Create(ctx context.Context, dino Dinosaur) (int64, error) {
+	err := r.a.write(func(d *memoryData) error {
+		if _, ok := d.cages[dino.CageId]; !ok {
+			return fmt.Errorf("%w: cage %d", ErrMissingReference, dino.CageId)
+		}
+		if _, ok := d.speciesByName(dino.Species); !ok {
+			return fmt.Errorf("%w: species %s", ErrMissingReference, dino.Species)
+		}
+		dino.Id = d.nextDinoId
+		d.nextDinoId++
+		dino.Version = 1
+		d.dinos[dino.Id] = dino
+		return nil
+	})
+	return dino.Id, err
+}
+
+func (r memoryDinoRepository) Update(ctx context.Context, dino Dinosaur) error {
+	return r.a.write(func(d *memoryData) error {
+		current, ok := d.dinos[dino.Id]
+		if !ok {
+			return sql.ErrNoRows
+		}
+		if _, ok := d.cages[dino.CageId]; !ok {
+			return fmt.Errorf("%w: cage %d", ErrMissingReference, dino.CageId)
+		}
+		// like the UPDATE statement only the name and cage can change
+		current.Name = dino.Name
+		current.CageId = dino.CageId
+		current.Version++
+		d.dinos[dino.Id] = current
+		return nil
+	})
+}
+
+func (r memoryDinoRepository) Delete(ctx context.Context, dinoId int64) error {
+	return r.a.write(func(d *memoryData) error {
+		_, live := d.dinos[dinoId]
+		_, archived := d.archivedDinos[dinoId]
+		if !live && !archived {
+			return sql.ErrNoRows
+		}
+		delete(d.dinos, dinoId)
+		delete(d.archivedDinos, dinoId)
+		return nil
+	})
+}
+
+func (r memoryDinoRepository) Archive(ctx context.Context, dinoId int64) error {
+	return r.a.write(func(d *memoryData) error {
+		dino, ok := d.dinos[dinoId]
+		if !ok {
+			return sql.ErrNoRows
+		}
+		d.archivedDinos[dinoId] = dino
+		delete(d.dinos, dinoId)
+		return nil
+	})
+}
+
+// filter returns the matching dinos ordered by id
+func (r memoryDinoRepository) filter(match func(dino Dinosaur) bool) ([]Dinosaur, error) {
+	dinos := []Dinosaur{}
+	err := r.a.read(func(d *memoryData) error {
+		for _, dinoId := range sortedKeys(d.dinos) {
+			if match(d.dinos[dinoId]) {
+				dinos = append(dinos, d.dinos[dinoId])
+			}
+		}
+		return nil
+	})
+	return dinos, err
+}
+
+type memoryCageRepository struct {
+	a memoryAccess
+}
+
+func (r memoryCageRepository) List(ctx context.Context, filter CageFilter) ([]Cage, error) {
+	cages := []Cage{}
+	err := r.a.read(func(d *memoryData) error {
+		for _, cageId := range sortedKeys(d.cages) {
+			cage := d.cages[cageId]
+			if filter.Status != "" && cage.Status != filter.Status {
+				continue
+			}
+			if cage.Id <= filter.AfterId {
+				continue
+			}
+			if filter.Limit > 0 && len(cages) == filter.Limit {
+				break
+			}
+			cages = append(cages, d.withOccupancy(cage))
+		}
+		return nil
+	})
+	return cages, err
+}
+
+func (r memoryCageRepository) Get(ctx context.Context, cageId int64) (Cage, error) {
+	var cage Cage
+	err := r.a.read(func(d *memoryData) error {
+		found, ok := d.cages[cageId]
+		if !ok {
+			return sql.ErrNoRows
+		}
+		cage = d.withOccupancy(found)
+		return nil
+	})
+	return cage, err
+}
+
+// GetForUpdate needs no lock of its own, transactions are already serialised
+func (r memoryCageRepository) GetForUpdate(ctx context.Context, cageId int64) (Cage, error) {
+	return r.Get(ctx, cageId)
+}
+
+func (r memoryCageRepository) Create(ctx context.Context, cage Cage) (int64, error) {
+	err := r.a.write(func(d *memoryData) error {
+		if d.cageNameTaken(cage) {
+			return fmt.Errorf("%w: cage_name %q", ErrDuplicate, cage.Name)
+		}
+		cage.Id = d.nextCageId
+		d.nextCageId++
+		cage.Occupancy = 0
+		cage.RemainingSlots = 0
+		cage.Version = 1
+		d.cages[cage.Id] = cage
+		return nil
+	})
+	return cage.Id, err
+}
+
+func (r memoryCageRepository) Update(ctx context.Context, cage Cage) error {
+	return r.a.write(func(d *memoryData) error {
+		current, ok := d.cages[cage.Id]
+		if !ok {
+			return sql.ErrNoRows
+		}
+		if d.cageNameTaken(cage) {
+			return fmt.Errorf("%w: cage_name %q", ErrDuplicate, cage.Name)
+		}
+		current.Name = cage.Name
+		current.Status = cage.Status
+		current.MaxCapacity = cage.MaxCapacity
+		current.Version++
+		d.cages[cage.Id] = current
+		return nil
+	})
+}
+
+func (r memoryCageRepository) Delete(ctx context.Context, cageId int64) error {
+	return r.a.write(func(d *memoryData) error {
+		// mirrors the foreign key from dinosaur.cage_id
+		for _, dinos := range []map[int64]Dinosaur{d.dinos, d.archivedDinos} {
+			for _, dino := range dinos {
+				if dino.CageId == cageId {
+					return ErrReferenced
+				}
+			}
+		}
+		_, live := d.cages[cageId]
+		_, archived := d.archivedCages[cageId]
+		if !live && !archived {
+			return sql.ErrNoRows
+		}
+		delete(d.cages, cageId)
+		delete(d.archivedCages, cageId)
+		return nil
+	})
+}
+
+func (r memoryCageRepository) Archive(ctx context.Context, cageId int64) error {
+	return r.a.write(func(d *memoryData) error {
+		cage, ok := d.cages[cageId]
+		if !ok {
+			return sql.ErrNoRows
+		}
+		d.archivedCages[cageId] = cage
+		delete(d.cages, cageId)
+		return nil
+	})
+}
+
+type memorySpeciesRepository struct {
+	a memoryAccess
+}
+
+func (r memorySpeciesRepository) List(ctx context.Context, filter SpeciesFilter) ([]Species, error) {
+	species := []Species{}
+	err := r.a.read(func(d *memoryData) error {
+		for _, speciesId := range sortedKeys(d.species) {
+			if speciesId <= filter.AfterId {
+				continue
+			}
+			if filter.Limit > 0 && len(species) == filter.Limit {
+				break
+			}
+			species = append(species, d.species[speciesId])
+		}
+		return nil
+	})
+	return species, err
+}
+
+func (r memorySpeciesRepository) GetByName(ctx context.Context, name string) (Species, error) {
+	var species Species
+	err := r.a.read(func(d *memoryData) error {
+		found, ok := d.speciesByName(name)
+		if !ok {
+			return sql.ErrNoRows
+		}
+		species = found
+		return nil
+	})
+	return species, err
+}
+
+func (r memorySpeciesRepository) Create(ctx context.Context, species Species) error {
+	return r.a.write(func(d *memoryData) error {
+		if _, ok := d.speciesByName(species.Name); ok {
+			return fmt.Errorf("%w: species %q", ErrDuplicate, species.Name)
+		}
+		species.Id = d.nextSpeciesId
+		d.nextSpeciesId++
+		d.species[species.Id] = species
+		return nil
+	})
+}
+
+func (r memorySpeciesRepository) Update(ctx context.Context, species Species) error {
+	return r.a.write(func(d *memoryData) error {
+		current, ok := d.speciesByName(species.Name)
+		if !ok {
+			return sql.ErrNoRows
+		}
+		current.Diet = species.Diet
+		d.species[current.Id] = current
+		return nil
+	})
+}
+
+func (r memorySpeciesRepository) Delete(ctx context.Context, name string) error {
+	return r.a.write(func(d *memoryData) error {
+		// mirrors the foreign key from dinosaur.dino_species
+		for _, dinos := range []map[int64]Dinosaur{d.dinos, d.archivedDinos} {
+			for _, dino := range dinos {
+				if dino.Species == name {
+					return ErrReferenced
+				}
+			}
+		}
+		current, ok := d.speciesByName(name)
+		if !ok {
+			return sql.ErrNoRows
+		}
+		delete(d.species, current.Id)
+		return nil
+	})
+}
+
+type memoryAuditRepository struct {
+	a memoryAccess
+}
+
+func (r memoryAuditRepository) Append(ctx context.Context, event AuditEvent) error {
+	return r.a.write(func(d *memoryData) error {
+		event.Id = int64(len(d.audit)) + 1
+		event.CreatedAt = time.Now().UTC()
+		d.audit = append(d.audit, event)
+		return nil
+	})
+}
+
+func (r memoryAuditRepository) List(ctx context.Context, filter AuditFilter) ([]AuditEvent, error) {
+	events := []AuditEvent{}
+	err := r.a.read(func(d *memoryData) error {
+		for _, event := range d.audit {
+			if event.Id <= filter.AfterId ||
+				(filter.Entity != "" && event.Entity != filter.Entity) ||
+				(filter.EntityId != 0 && event.EntityId != filter.EntityId) ||
+				(!filter.From.IsZero() && event.CreatedAt.Before(filter.From)) ||
+				(!filter.To.IsZero() && !event.CreatedAt.Before(filter.To)) {
+				continue
+			}
+			if filter.Limit > 0 && len(events) == filter.Limit {
+				break
+			}
+			events = append(events, event)
+		}
+		return nil
+	})
+	return events, err
+}
+
+type memoryPlacementRepository struct {
+	a memoryAccess
+}
+
+func (r memoryPlacementRepository) Move(ctx context.Context, dinoId int64, cageId int64) error {
+	return r.a.write(func(d *memoryData) error {
+		now := time.Now().UTC()
+		d.endPlacement(dinoId, now)
+		d.placements = append(d.placements, DinoPlacement{
+			Id:     int64(len(d.placements)) + 1,
+			DinoId: dinoId,
+			CageId: cageId,
+			From:   now,
+		})
+		return nil
+	})
+}
+
+func (r memoryPlacementRepository) End(ctx context.Context, dinoId int64) error {
+	return r.a.write(func(d *memoryData) error {
+		d.endPlacement(dinoId, time.Now().UTC())
+		return nil
+	})
+}
+
+func (r memoryPlacementRepository) ListByDino(ctx context.Context, dinoId int64, filter PlacementFilter) ([]DinoPlacement, error) {
+	return r.filter(func(p DinoPlacement) bool { return p.DinoId == dinoId && p.Id > filter.AfterId }, filter.Limit)
+}
+
+func (r memoryPlacementRepository) ListByCageAt(ctx context.Context, cageId int64, at time.Time) ([]DinoPlacement, error) {
+	return r.filter(func(p DinoPlacement) bool {
+		return p.CageId == cageId && !p.From.After(at) && (p.To == nil || p.To.After(at))
+	}, 0)
+}
+
+// filter returns up to limit matching placements, with the dino name and species filled in like the join does
+func (r memoryPlacementRepository) filter(match func(p DinoPlacement) bool, limit int) ([]DinoPlacement, error) {
+	placements := []DinoPlacement{}
+	err := r.a.read(func(d *memoryData) error {
+		for _, placement := range d.placements {
+			if !match(placement) {
+				continue
+			}
+			if limit > 0 && len(placements) == limit {
+				break
+			}
+			dino, ok := d.dinos[placement.DinoId]
+			if !ok {
+				dino = d.archivedDinos[placement.DinoId]
+			}
+			placement.DinoName = dino.Name
+			placement.DinoSpecies = dino.Species
+			placements = append(placements, placement)
+		}
+		return nil
+	})
+	return placements, err
+}
+
+type memoryAPIKeyRepository struct {
+	a memoryAccess
+}
+
+func (r memoryAPIKeyRepository) Create(ctx context.Context, key APIKey) (int64, error) {
+	err := r.a.write(func(d *memoryData) error {
+		for _, existing := range d.apiKeys {
+			if existing.Hash == key.Hash {
+				return fmt.Errorf("%w: api key %s", ErrDuplicate, key.Prefix)
+			}
+		}
+		key.Id = d.nextKeyId
+		d.nextKeyId++
+		key.Scopes = slices.Clone(key.Scopes)
+		key.CreatedAt = time.Now().UTC()
+		key.LastUsedAt = nil
+		key.RevokedAt = nil
+		d.apiKeys[key.Id] = key
+		return nil
+	})
+	return key.Id, err
+}
+
+func (r memoryAPIKeyRepository) List(ctx context.Context, filter APIKeyFilter) ([]APIKey, error) {
+	keys := []APIKey{}
+	err := r.a.read(func(d *memoryData) error {
+		for _, keyId := range sortedKeys(d.apiKeys) {
+			if keyId <= filter.AfterId {
+				continue
+			}
+			if filter.Limit > 0 && len(keys) == filter.Limit {
+				break
+			}
+			keys = append(keys, d.apiKeys[keyId])
+		}
+		return nil
+	})
+	return keys, err
+}
+
+func (r memoryAPIKeyRepository) Get(ctx context.Context, keyId int64) (APIKey, error) {
+	var key APIKey
+	err := r.a.read(func(d *memoryData) error {
+		found, ok := d.apiKeys[keyId]
+		if !ok {
+			return sql.ErrNoRows
+		}
+		key = found
+		return nil
+	})
+	return key, err
+}
+
+func (r memoryAPIKeyRepository) GetByHash(ctx context.Context, hash string) (APIKey, error) {
+	var key APIKey
+	err := r.a.read(func(d *memoryData) error {
+		for _, found := range d.apiKeys {
+			if found.Hash == hash {
+				key = found
+				return nil
+			}
+		}
+		return sql.ErrNoRows
+	})
+	return key, err
+}
+
+// UpdateScopes, Revoke and Touch replace the stored key rather than change it, readers may still hold it
+
+func (r memoryAPIKeyRepository) UpdateScopes(ctx context.Context, keyId int64, scopes []string) error {
+	return r.a.write(func(d *memoryData) error {
+		key, ok := d.apiKeys[keyId]
+		if !ok {
+			return sql.ErrNoRows
+		}
+		key.Scopes = slices.Clone(scopes)
+		d.apiKeys[keyId] = key
+		return nil
+	})
+}
+
+func (r memoryAPIKeyRepository) Revoke(ctx context.Context, keyId int64) error {
+	return r.a.write(func(d *memoryData) error {
+		key, ok := d.apiKeys[keyId]
+		if !ok || key.RevokedAt != nil {
+			return sql.ErrNoRows
+		}
+		now := time.Now().UTC()
+		key.RevokedAt = &now
+		d.apiKeys[keyId] = key
+		return nil
+	})
+}
+
+func (r memoryAPIKeyRepository) Touch(ctx context.Context, keyId int64, at time.Time) error {
+	return r.a.write(func(d *memoryData) error {
+		key, ok := d.apiKeys[keyId]
+		if !ok {
+			return sql.ErrNoRows
+		}
+		key.LastUsedAt = &at
+		d.apiKeys[keyId] = key
+		return nil
+	})
+}
+
+type memoryEventRepository struct {
+	a memoryAccess
+}
+
+func (r memoryEventRepository) Append(ctx context.Context, event ParkEvent) error {
+	return r.a.write(func(d *memoryData) error {
+		event.Id = int64(len(d.events)) + 1
+		event.CreatedAt = time.Now().UTC()
+		d.events = append(d.events, event)
+		return nil
+	})
+}
+
+func (r memoryEventRepository) List(ctx context.Context, filter ParkEventFilter) ([]ParkEvent, error) {
+	events := []ParkEvent{}
+	err := r.a.read(func(d *memoryData) error {
+		// the id of an event is its index plus one
+		for _, event := range d.events[min(filter.AfterId, int64(len(d.events))):] {
+			if filter.Limit > 0 && len(events) == filter.Limit {
+				break
+			}
+			events = append(events, event)
+		}
+		return nil
+	})
+	return events, err
+}
+
+func (r memoryEventRepository) LastId(ctx context.Context) (int64, error) {
+	var id int64
+	err := r.a.read(func(d *memoryData) error {
+		id = int64(len(d.events))
+		return nil
+	})
+	return id, err
+}
+
+type memoryIdempotencyRepository struct {
+	a memoryAccess
+}
+
+func (r memoryIdempotencyRepository) Reserve(ctx context.Context, request IdempotentRequest, now time.Time) error {
+	return r.a.write(func(d *memoryData) error {
+		key := [2]string{request.Subject, request.Key}
+		if existing, ok := d.idempotency[key]; ok && existing.ExpiresAt.After(now) {
+			return fmt.Errorf("%w: idempotency key %s", ErrDuplicate, request.Key)
+		}
+		request.Status = 0
+		request.Header = nil
+		request.Body = nil
+		d.idempotency[key] = request
+		return nil
+	})
+}
+
+func (r memoryIdempotencyRepository) Get(ctx context.Context, subject string, key string, now time.Time) (IdempotentRequest, error) {
+	var request IdempotentRequest
+	err := r.a.read(func(d *memoryData) error {
+		found, ok := d.idempotency[[2]string{subject, key}]
+		if !ok || !found.ExpiresAt.After(now) {
+			return sql.ErrNoRows
+		}
+		request = found
+		return nil
+	})
+	return request, err
+}
+
+func (r memoryIdempotencyRepository) Complete(ctx context.Context, request IdempotentRequest) error {
+	return r.a.write(func(d *memoryData) error {
+		key := [2]string{request.Subject, request.Key}
+		stored, ok := d.idempotency[key]
+		if !ok {
+			return sql.ErrNoRows
+		}
+		stored.Status = request.Status
+		stored.Header = maps.Clone(request.Header)
+		stored.Body = slices.Clone(request.Body)
+		stored.ExpiresAt = request.ExpiresAt
+		d.idempotency[key] = stored
+		return nil
+	})
+}
+
+func (r memoryIdempotencyRepository) Release(ctx context.Context, subject string, key string) error {
+	return r.a.write(func(d *memoryData) error {
+		stored, ok := d.idempotency[[2]string{subject, key}]
+		if !ok || stored.Status != 0 {
+			return sql.ErrNoRows
+		}
+		delete(d.idempotency, [2]string{subject, key})
+		return nil
+	})
+}
+
+func (r memoryIdempotencyRepository) DeleteExpired(ctx context.Context, now time.Time) (int64, error) {
+	var deleted int64
+	err := r.a.write(func(d *memoryData) error {
+		for key, request := range d.idempotency {
+			if !request.ExpiresAt.After(now) {
+				delete(d.idempotency, key)
+				deleted++
+			}
+		}
+		return nil
+	})
+	return deleted, err
+}
+
+func (d *memoryData) endPlacement(dinoId int64, at time.Time) {
+	for i, placement := range d.placements {
+		if placement.DinoId == dinoId && placement.To == nil {
+			d.placements[i].To = &at
+		}
+	}
+}
+
+func (d *memoryData) speciesByName(name string) (Species, bool) {
+	for _, species := range d.species {
+		if species.Name == name {
+			return species, true
+		}
+	}
+	return Species{}, false
+}
+
+// withOccupancy fills in the computed occupancy fields the way the postgres queries do
+func (d *memoryData) withOccupancy(cage Cage) Cage {
+	cage.Occupancy = 0
+	for _, dino := range d.dinos {
+		if dino.CageId == cage.Id {
+			cage.Occupancy++
+		}
+	}
+	cage.RemainingSlots = max(cage.MaxCapacity-cage.Occupancy, 0)
+	return cage
+}
+
+// cageNameTaken mirrors the UNIQUE constraint on cage_name, which archived cages still hold
+func (d *memoryData) cageNameTaken(cage Cage) bool {
+	for _, cages := range []map[int64]Cage{d.cages, d.archivedCages} {
+		for _, other := range cages {
+			if other.Name == cage.Name && other.Id != cage.Id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func sortedKeys[V any](m map[int64]V) []int64 {
+	keys := make([]int64, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
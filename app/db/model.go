@@ -0,0 +1,152 @@
+package db
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Dinosaur, Cage and Species are shared by the repositories and the app package, which aliases them
+
+type Dinosaur struct {
+	Id     int64  `json:"id"`
+	CageId int64  `json:"cage_id" validate:"required"`
+	Name   string `json:"dino_name" validate:"required"`
+	// Species must name a row in the species table
+	Species string `json:"dino_species" validate:"required"`
+	// Version goes up by one on every update and is ignored on write
+	Version int64 `json:"version"`
+}
+
+type Cage struct {
+	Id          int64  `json:"id"`
+	Name        string `json:"cage_name" validate:"required"`
+	Status      string `json:"cage_status" validate:"oneof=ACTIVE DOWN"`
+	MaxCapacity int64  `json:"max_capacity" validate:"required,gt=0"`
+	// Occupancy and RemainingSlots are computed on read and ignored on write
+	Occupancy      int64 `json:"occupancy"`
+	RemainingSlots int64 `json:"remaining_slots"`
+	// Version goes up by one on every update and is ignored on write
+	Version int64 `json:"version"`
+}
+
+type Species struct {
+	Id   int64  `json:"id"`
+	Name string `json:"name" validate:"required"`
+	Diet string `json:"diet" validate:"oneof=carnivore herbivore"`
+}
+
+// DinoFilter narrows a dino listing, zero values match everything
+type DinoFilter struct {
+	CageId  int64
+	Species string
+	// Diet matches the dinos whose species has that diet
+	Diet string
+	// AfterId and Limit page through the results in id order
+	AfterId int64
+	Limit   int
+}
+
+// CageFilter narrows a cage listing, zero values match everything
+type CageFilter struct {
+	Status string `json:"status" validate:"omitempty,oneof=ACTIVE DOWN"`
+	// AfterId and Limit page through the results in id order
+	AfterId int64 `validate:"-"`
+	Limit   int   `validate:"-"`
+}
+
+// SpeciesFilter pages through the species in id order
+type SpeciesFilter struct {
+	AfterId int64
+	Limit   int
+}
+
+// AuditEvent records one change to a row, Before is null for a create and After is null for a delete
+type AuditEvent struct {
+	Id       int64  `json:"id"`
+	Actor    string `json:"actor"`
+	Action   string `json:"action"`
+	Entity   string `json:"entity"`
+	EntityId int64  `json:"entity_id"`
+	// Before and After are the row as JSON
+	Before    json.RawMessage `json:"before"`
+	After     json.RawMessage `json:"after"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// AuditFilter narrows an audit listing, zero values match everything
+type AuditFilter struct {
+	Entity   string
+	EntityId int64
+	// From is inclusive and To exclusive
+	From time.Time
+	To   time.Time
+	// AfterId and Limit page through the results in id order
+	AfterId int64
+	Limit   int
+}
+
+// DinoPlacement is a stay of a dino in a cage, To is nil while the dino is still there.
+// DinoName and DinoSpecies are empty once the dino has been deleted.
+type DinoPlacement struct {
+	Id          int64      `json:"id"`
+	DinoId      int64      `json:"dino_id"`
+	DinoName    string     `json:"dino_name"`
+	DinoSpecies string     `json:"dino_species"`
+	CageId      int64      `json:"cage_id"`
+	From        time.Time  `json:"from"`
+	To          *time.Time `json:"to"`
+}
+
+// PlacementFilter pages through the placements in id order
+type PlacementFilter struct {
+	AfterId int64
+	Limit   int
+}
+
+// APIKey is a long lived credential for a machine client, only the hash of the key is kept
+type APIKey struct {
+	Id   int64  `json:"id"`
+	Name string `json:"name"`
+	// Prefix is the start of the key, enough to tell keys apart
+	Prefix     string     `json:"prefix"`
+	Hash       string     `json:"-"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+// APIKeyFilter pages through the api keys in id order
+type APIKeyFilter struct {
+	AfterId int64
+	Limit   int
+}
+
+// ParkEvent is a change to the park as published on the event stream, Data depends on the Type
+type ParkEvent struct {
+	Id        int64           `json:"id"`
+	Type      string          `json:"type"`
+	Data      json.RawMessage `json:"data"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// ParkEventFilter pages through the park events in id order
+type ParkEventFilter struct {
+	AfterId int64
+	Limit   int
+}
+
+// IdempotentRequest is a request sent with an Idempotency-Key, keys belong to the caller that sent them.
+// Once the request has been answered it holds the response, which is replayed to retries until it expires.
+type IdempotentRequest struct {
+	Subject string
+	Key     string
+	// Fingerprint is a hash of the request, a retry must send the same request
+	Fingerprint string
+	// Status is 0 while the request is still being handled
+	Status int
+	Header map[string]string
+	Body   []byte
+	// ExpiresAt is the end of the lease while the request is handled, then of the time its response is kept
+	ExpiresAt time.Time
+}
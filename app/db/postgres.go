@@ -0,0 +1,657 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// querier is satisfied by both *sql.DB and *sql.Tx
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+type postgresTx struct {
+	tx *sql.Tx
+}
+
+func (t postgresTx) Dinos() DinoRepository {
+	return postgresDinoRepository{q: t.tx}
+}
+
+func (t postgresTx) Cages() CageRepository {
+	return postgresCageRepository{q: t.tx}
+}
+
+func (t postgresTx) Species() SpeciesRepository {
+	return postgresSpeciesRepository{q: t.tx}
+}
+
+func (t postgresTx) Audit() AuditRepository {
+	return postgresAuditRepository{q: t.tx}
+}
+
+func (t postgresTx) Placements() PlacementRepository {
+	return postgresPlacementRepository{q: t.tx}
+}
+
+func (t postgresTx) APIKeys() APIKeyRepository {
+	return postgresAPIKeyRepository{q: t.tx}
+}
+
+func (t postgresTx) Idempotency() IdempotencyRepository {
+	return postgresIdempotencyRepository{q: t.tx}
+}
+
+func (t postgresTx) Events() EventRepository {
+	return postgresEventRepository{q: t.tx}
+}
+
+// archived rows are kept for history but never read back, every query filters them out
+
+type postgresDinoRepository struct {
+	q querier
+}
+
+func (r postgresDinoRepository) List(ctx context.Context, filter DinoFilter) ([]Dinosaur, error) {
+	query := "SELECT id, dino_name, dino_species, cage_id, version FROM dinosaur where archived_at IS NULL"
+	args := []any{}
+	if filter.CageId != 0 {
+		args = append(args, filter.CageId)
+		query += fmt.Sprintf(" AND cage_id = $%d", len(args))
+	}
+	if filter.Species != "" {
+		args = append(args, filter.Species)
+		query += fmt.Sprintf(" AND dino_species = $%d", len(args))
+	}
+	if filter.Diet != "" {
+		args = append(args, filter.Diet)
+		query += fmt.Sprintf(" AND dino_species IN (SELECT name FROM species WHERE diet = $%d)", len(args))
+	}
+	if filter.AfterId != 0 {
+		args = append(args, filter.AfterId)
+		query += fmt.Sprintf(" AND id > $%d", len(args))
+	}
+	query += " ORDER BY ID ASC"
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+	return r.query(ctx, query, args...)
+}
+
+func (r postgresDinoRepository) Get(ctx context.Context, dinoId int64) (Dinosaur, error) {
+	return r.queryRow(ctx, "SELECT id, dino_name, dino_species, cage_id, version FROM dinosaur where id=$1 AND archived_at IS NULL", dinoId)
+}
+
+func (r postgresDinoRepository) GetForUpdate(ctx context.Context, dinoId int64) (Dinosaur, error) {
+	return r.queryRow(ctx, "SELECT id, dino_name, dino_species, cage_id, version FROM dinosaur where id=$1 AND archived_at IS NULL FOR UPDATE", dinoId)
+}
+
+func (r postgresDinoRepository) ListByCage(ctx context.Context, cageId int64) ([]Dinosaur, error) {
+	return r.query(ctx, "SELECT id, dino_name, dino_species, cage_id, version FROM dinosaur where cage_id = $1 AND archived_at IS NULL ORDER BY ID ASC", cageId)
+}
+
+func (r postgresDinoRepository) Create(ctx context.Context, dino Dinosaur) (int64, error) {
+	var id int64
+	row := r.q.QueryRowContext(ctx, "INSERT INTO dinosaur ( dino_name, dino_species, cage_id) VALUES ($1, $2, $3) RETURNING id", dino.Name, dino.Species, dino.CageId)
+	err := row.Scan(&id)
+	return id, constraintError(err)
+}
+
+func (r postgresDinoRepository) Update(ctx context.Context, dino Dinosaur) error {
+	query := `UPDATE dinosaur set 
+		dino_name = $1,
+		cage_id = $2,
+		version = version + 1
+		where id = $3 AND archived_at IS NULL`
+
+	result, err := r.q.ExecContext(ctx, query, dino.Name, dino.CageId, dino.Id)
+	return rowAffected(result, constraintError(err))
+}
+
+func (r postgresDinoRepository) Delete(ctx context.Context, dinoId int64) error {
+	result, err := r.q.ExecContext(ctx, "DELETE FROM dinosaur where id = $1", dinoId)
+	return rowAffected(result, err)
+}
+
+func (r postgresDinoRepository) Archive(ctx context.Context, dinoId int64) error {
+	result, err := r.q.ExecContext(ctx, "UPDATE dinosaur set archived_at = now() where id = $1 AND archived_at IS NULL", dinoId)
+	return rowAffected(result, err)
+}
+
+func (r postgresDinoRepository) query(ctx context.Context, query string, args ...any) ([]Dinosaur, error) {
+	dinos := []Dinosaur{}
+	rows, err := r.q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return dinos, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var dino Dinosaur
+		err := rows.Scan(&dino.Id, &dino.Name, &dino.Species, &dino.CageId, &dino.Version)
+		if err != nil {
+			return dinos, err
+		}
+		dinos = append(dinos, dino)
+	}
+	return dinos, rows.Err()
+}
+
+func (r postgresDinoRepository) queryRow(ctx context.Context, query string, args ...any) (Dinosaur, error) {
+	dino := Dinosaur{}
+	row := r.q.QueryRowContext(ctx, query, args...)
+	err := row.Scan(&dino.Id, &dino.Name, &dino.Species, &dino.CageId, &dino.Version)
+	return dino, err
+}
+
+type postgresCageRepository struct {
+	q querier
+}
+
+// cageSelect reads cages along with the number of dinos in each
+const cageSelect = `SELECT c.id, c.cage_name, c.cage_status, c.max_capacity, c.version,
+		(SELECT COUNT(*) FROM dinosaur d WHERE d.cage_id = c.id AND d.archived_at IS NULL)
+		FROM cage c
+		WHERE c.archived_at IS NULL`
+
+func (r postgresCageRepository) List(ctx context.Context, filter CageFilter) ([]Cage, error) {
+	cages := []Cage{}
+	query := cageSelect
+	args := []any{}
+	if filter.Status != "" {
+		args = append(args, filter.Status)
+		query += fmt.Sprintf(" AND c.cage_status = $%d", len(args))
+	}
+	if filter.AfterId != 0 {
+		args = append(args, filter.AfterId)
+		query += fmt.Sprintf(" AND c.id > $%d", len(args))
+	}
+	query += " ORDER BY c.id ASC"
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+	rows, err := r.q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return cages, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cage Cage
+		err := rows.Scan(&cage.Id, &cage.Name, &cage.Status, &cage.MaxCapacity, &cage.Version, &cage.Occupancy)
+		if err != nil {
+			return cages, err
+		}
+		cage.RemainingSlots = max(cage.MaxCapacity-cage.Occupancy, 0)
+		cages = append(cages, cage)
+	}
+	return cages, rows.Err()
+}
+
+func (r postgresCageRepository) Get(ctx context.Context, cageId int64) (Cage, error) {
+	return r.queryRow(ctx, cageSelect+" AND c.id=$1", cageId)
+}
+
+// GetForUpdate counts the occupants in a second statement, once the lock is held,
+// a count in the locking statement would use a snapshot from before any wait for the lock
+func (r postgresCageRepository) GetForUpdate(ctx context.Context, cageId int64) (Cage, error) {
+	cage := Cage{}
+	row := r.q.QueryRowContext(ctx, "SELECT id, cage_name, cage_status, max_capacity, version FROM cage where id=$1 AND archived_at IS NULL FOR UPDATE", cageId)
+	err := row.Scan(&cage.Id, &cage.Name, &cage.Status, &cage.MaxCapacity, &cage.Version)
+	if err != nil {
+		return cage, err
+	}
+	row = r.q.QueryRowContext(ctx, "SELECT COUNT(*) FROM dinosaur where cage_id=$1 AND archived_at IS NULL", cageId)
+	err = row.Scan(&cage.Occupancy)
+	if err != nil {
+		return cage, err
+	}
+	cage.RemainingSlots = max(cage.MaxCapacity-cage.Occupancy, 0)
+	return cage, nil
+}
+
+func (r postgresCageRepository) Create(ctx context.Context, cage Cage) (int64, error) {
+	var id int64
+	row := r.q.QueryRowContext(ctx, "INSERT INTO cage ( cage_name, cage_status, max_capacity) VALUES ($1, $2, $3) RETURNING id", cage.Name, cage.Status, cage.MaxCapacity)
+	err := row.Scan(&id)
+	return id, constraintError(err)
+}
+
+func (r postgresCageRepository) Update(ctx context.Context, cage Cage) error {
+	query := `UPDATE cage set 
+		cage_status = $1,
+		cage_name = $2,
+		max_capacity = $3,
+		version = version + 1
+		where id = $4 AND archived_at IS NULL`
+
+	result, err := r.q.ExecContext(ctx, query, cage.Status, cage.Name, cage.MaxCapacity, cage.Id)
+	return rowAffected(result, constraintError(err))
+}
+
+func (r postgresCageRepository) Delete(ctx context.Context, cageId int64) error {
+	result, err := r.q.ExecContext(ctx, "DELETE FROM cage where id = $1", cageId)
+	return rowAffected(result, referencedError(err))
+}
+
+func (r postgresCageRepository) Archive(ctx context.Context, cageId int64) error {
+	result, err := r.q.ExecContext(ctx, "UPDATE cage set archived_at = now() where id = $1 AND archived_at IS NULL", cageId)
+	return rowAffected(result, err)
+}
+
+func (r postgresCageRepository) queryRow(ctx context.Context, query string, args ...any) (Cage, error) {
+	cage := Cage{}
+	row := r.q.QueryRowContext(ctx, query, args...)
+	err := row.Scan(&cage.Id, &cage.Name, &cage.Status, &cage.MaxCapacity, &cage.Version, &cage.Occupancy)
+	if err != nil {
+		return cage, err
+	}
+	cage.RemainingSlots = max(cage.MaxCapacity-cage.Occupancy, 0)
+	return cage, nil
+}
+
+type postgresSpeciesRepository struct {
+	q querier
+}
+
+func (r postgresSpeciesRepository) List(ctx context.Context, filter SpeciesFilter) ([]Species, error) {
+	species := []Species{}
+	query := "SELECT id, name, diet FROM species where id > $1 ORDER BY id ASC"
+	args := []any{filter.AfterId}
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		query += " LIMIT $2"
+	}
+	rows, err := r.q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return species, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s Species
+		err := rows.Scan(&s.Id, &s.Name, &s.Diet)
+		if err != nil {
+			return species, err
+		}
+		species = append(species, s)
+	}
+	return species, rows.Err()
+}
+
+func (r postgresSpeciesRepository) GetByName(ctx context.Context, name string) (Species, error) {
+	species := Species{}
+	row := r.q.QueryRowContext(ctx, "SELECT id, name, diet FROM species where name = $1", name)
+	err := row.Scan(&species.Id, &species.Name, &species.Diet)
+	return species, err
+}
+
+func (r postgresSpeciesRepository) Create(ctx context.Context, species Species) error {
+	_, err := r.q.ExecContext(ctx, "INSERT INTO species ( name, diet) VALUES ($1, $2)", species.Name, species.Diet)
+	return constraintError(err)
+}
+
+func (r postgresSpeciesRepository) Update(ctx context.Context, species Species) error {
+	result, err := r.q.ExecContext(ctx, "UPDATE species set diet = $1 where name = $2", species.Diet, species.Name)
+	return rowAffected(result, err)
+}
+
+func (r postgresSpeciesRepository) Delete(ctx context.Context, name string) error {
+	result, err := r.q.ExecContext(ctx, "DELETE FROM species where name = $1", name)
+	return rowAffected(result, referencedError(err))
+}
+
+type postgresAuditRepository struct {
+	q querier
+}
+
+func (r postgresAuditRepository) Append(ctx context.Context, event AuditEvent) error {
+	query := `INSERT INTO audit_event (actor, action, entity, entity_id, before, after)
+		VALUES ($1, $2, $3, $4, $5, $6)`
+	_, err := r.q.ExecContext(ctx, query, event.Actor, event.Action, event.Entity, event.EntityId, []byte(event.Before), []byte(event.After))
+	return err
+}
+
+func (r postgresAuditRepository) List(ctx context.Context, filter AuditFilter) ([]AuditEvent, error) {
+	events := []AuditEvent{}
+	query := "SELECT id, actor, action, entity, entity_id, before, after, created_at FROM audit_event where true"
+	args := []any{}
+	if filter.Entity != "" {
+		args = append(args, filter.Entity)
+		query += fmt.Sprintf(" AND entity = $%d", len(args))
+	}
+	if filter.EntityId != 0 {
+		args = append(args, filter.EntityId)
+		query += fmt.Sprintf(" AND entity_id = $%d", len(args))
+	}
+	if !filter.From.IsZero() {
+		args = append(args, filter.From)
+		query += fmt.Sprintf(" AND created_at >= $%d", len(args))
+	}
+	if !filter.To.IsZero() {
+		args = append(args, filter.To)
+		query += fmt.Sprintf(" AND created_at < $%d", len(args))
+	}
+	if filter.AfterId != 0 {
+		args = append(args, filter.AfterId)
+		query += fmt.Sprintf(" AND id > $%d", len(args))
+	}
+	query += " ORDER BY id ASC"
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+	rows, err := r.q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return events, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var event AuditEvent
+		var before, after []byte
+		err := rows.Scan(&event.Id, &event.Actor, &event.Action, &event.Entity, &event.EntityId, &before, &after, &event.CreatedAt)
+		if err != nil {
+			return events, err
+		}
+		event.Before = before
+		event.After = after
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+type postgresPlacementRepository struct {
+	q querier
+}
+
+// placementSelect reads placements along with the dino, archived or not
+const placementSelect = `SELECT p.id, p.dino_id, COALESCE(d.dino_name, ''), COALESCE(d.dino_species, ''), p.cage_id, p.placed_at, p.removed_at
+		FROM dinosaur_placement p
+		LEFT JOIN dinosaur d ON d.id = p.dino_id`
+
+// Move uses now(), the start of the transaction, for both ends so there is no gap between them
+func (r postgresPlacementRepository) Move(ctx context.Context, dinoId int64, cageId int64) error {
+	err := r.End(ctx, dinoId)
+	if err != nil {
+		return err
+	}
+	_, err = r.q.ExecContext(ctx, "INSERT INTO dinosaur_placement (dino_id, cage_id, placed_at) VALUES ($1, $2, now())", dinoId, cageId)
+	return err
+}
+
+func (r postgresPlacementRepository) End(ctx context.Context, dinoId int64) error {
+	_, err := r.q.ExecContext(ctx, "UPDATE dinosaur_placement set removed_at = now() where dino_id = $1 AND removed_at IS NULL", dinoId)
+	return err
+}
+
+func (r postgresPlacementRepository) ListByDino(ctx context.Context, dinoId int64, filter PlacementFilter) ([]DinoPlacement, error) {
+	query := placementSelect + " WHERE p.dino_id = $1 AND p.id > $2 ORDER BY p.id ASC"
+	args := []any{dinoId, filter.AfterId}
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		query += " LIMIT $3"
+	}
+	return r.query(ctx, query, args...)
+}
+
+func (r postgresPlacementRepository) ListByCageAt(ctx context.Context, cageId int64, at time.Time) ([]DinoPlacement, error) {
+	query := placementSelect + ` WHERE p.cage_id = $1 AND p.placed_at <= $2 AND (p.removed_at IS NULL OR p.removed_at > $2)
+		ORDER BY p.id ASC`
+	return r.query(ctx, query, cageId, at)
+}
+
+func (r postgresPlacementRepository) query(ctx context.Context, query string, args ...any) ([]DinoPlacement, error) {
+	placements := []DinoPlacement{}
+	rows, err := r.q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return placements, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var placement DinoPlacement
+		err := rows.Scan(&placement.Id, &placement.DinoId, &placement.DinoName, &placement.DinoSpecies,
+			&placement.CageId, &placement.From, &placement.To)
+		if err != nil {
+			return placements, err
+		}
+		placements = append(placements, placement)
+	}
+	return placements, rows.Err()
+}
+
+type postgresAPIKeyRepository struct {
+	q querier
+}
+
+const apiKeySelect = "SELECT id, name, prefix, key_hash, scopes, created_at, last_used_at, revoked_at FROM api_key"
+
+func (r postgresAPIKeyRepository) Create(ctx context.Context, key APIKey) (int64, error) {
+	var id int64
+	row := r.q.QueryRowContext(ctx, "INSERT INTO api_key (name, prefix, key_hash, scopes) VALUES ($1, $2, $3, $4) RETURNING id",
+		key.Name, key.Prefix, key.Hash, pq.Array(key.Scopes))
+	err := row.Scan(&id)
+	return id, constraintError(err)
+}
+
+func (r postgresAPIKeyRepository) List(ctx context.Context, filter APIKeyFilter) ([]APIKey, error) {
+	keys := []APIKey{}
+	query := apiKeySelect + " where id > $1 ORDER BY id ASC"
+	args := []any{filter.AfterId}
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		query += " LIMIT $2"
+	}
+	rows, err := r.q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return keys, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return keys, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (r postgresAPIKeyRepository) Get(ctx context.Context, keyId int64) (APIKey, error) {
+	return scanAPIKey(r.q.QueryRowContext(ctx, apiKeySelect+" where id = $1", keyId))
+}
+
+func (r postgresAPIKeyRepository) GetByHash(ctx context.Context, hash string) (APIKey, error) {
+	return scanAPIKey(r.q.QueryRowContext(ctx, apiKeySelect+" where key_hash = $1", hash))
+}
+
+func (r postgresAPIKeyRepository) UpdateScopes(ctx context.Context, keyId int64, scopes []string) error {
+	result, err := r.q.ExecContext(ctx, "UPDATE api_key set scopes = $1 where id = $2", pq.Array(scopes), keyId)
+	return rowAffected(result, err)
+}
+
+func (r postgresAPIKeyRepository) Revoke(ctx context.Context, keyId int64) error {
+	result, err := r.q.ExecContext(ctx, "UPDATE api_key set revoked_at = now() where id = $1 AND revoked_at IS NULL", keyId)
+	return rowAffected(result, err)
+}
+
+func (r postgresAPIKeyRepository) Touch(ctx context.Context, keyId int64, at time.Time) error {
+	result, err := r.q.ExecContext(ctx, "UPDATE api_key set last_used_at = $1 where id = $2", at, keyId)
+	return rowAffected(result, err)
+}
+
+type postgresEventRepository struct {
+	q querier
+}
+
+// parkEventLock is the advisory lock taken before an event is appended
+const parkEventLock = 7396
+
+// Append holds a lock until the transaction ends. Ids come from a sequence, without the lock a transaction
+// could commit a lower id after a reader had already moved past it. The lock serializes the commits of
+// every transaction that appends, so it should be the last statement before the commit.
+func (r postgresEventRepository) Append(ctx context.Context, event ParkEvent) error {
+	_, err := r.q.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", parkEventLock)
+	if err != nil {
+		return err
+	}
+	_, err = r.q.ExecContext(ctx, "INSERT INTO park_event (type, data) VALUES ($1, $2)", event.Type, []byte(event.Data))
+	return err
+}
+
+func (r postgresEventRepository) List(ctx context.Context, filter ParkEventFilter) ([]ParkEvent, error) {
+	events := []ParkEvent{}
+	query := "SELECT id, type, data, created_at FROM park_event where id > $1 ORDER BY id ASC"
+	args := []any{filter.AfterId}
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		query += " LIMIT $2"
+	}
+	rows, err := r.q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return events, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var event ParkEvent
+		var data []byte
+		err := rows.Scan(&event.Id, &event.Type, &data, &event.CreatedAt)
+		if err != nil {
+			return events, err
+		}
+		event.Data = data
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func (r postgresEventRepository) LastId(ctx context.Context) (int64, error) {
+	var id int64
+	err := r.q.QueryRowContext(ctx, "SELECT COALESCE(MAX(id), 0) FROM park_event").Scan(&id)
+	return id, err
+}
+
+type postgresIdempotencyRepository struct {
+	q querier
+}
+
+// Reserve only overwrites a row that has expired, a live one leaves nothing affected
+func (r postgresIdempotencyRepository) Reserve(ctx context.Context, request IdempotentRequest, now time.Time) error {
+	query := `INSERT INTO idempotency_request (subject, idempotency_key, fingerprint, expires_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (subject, idempotency_key) DO UPDATE SET
+		fingerprint = EXCLUDED.fingerprint,
+		status = 0,
+		header = NULL,
+		body = NULL,
+		expires_at = EXCLUDED.expires_at
+		WHERE idempotency_request.expires_at <= $5`
+
+	result, err := r.q.ExecContext(ctx, query, request.Subject, request.Key, request.Fingerprint, request.ExpiresAt, now)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return fmt.Errorf("%w: idempotency key %s", ErrDuplicate, request.Key)
+	}
+	return nil
+}
+
+func (r postgresIdempotencyRepository) Get(ctx context.Context, subject string, key string, now time.Time) (IdempotentRequest, error) {
+	request := IdempotentRequest{}
+	var header []byte
+	row := r.q.QueryRowContext(ctx, `SELECT subject, idempotency_key, fingerprint, status, header, body, expires_at FROM idempotency_request
+		where subject = $1 AND idempotency_key = $2 AND expires_at > $3`, subject, key, now)
+	err := row.Scan(&request.Subject, &request.Key, &request.Fingerprint, &request.Status, &header, &request.Body, &request.ExpiresAt)
+	if err != nil {
+		return request, err
+	}
+	if header != nil {
+		err = json.Unmarshal(header, &request.Header)
+	}
+	return request, err
+}
+
+func (r postgresIdempotencyRepository) Complete(ctx context.Context, request IdempotentRequest) error {
+	header, err := json.Marshal(request.Header)
+	if err != nil {
+		return err
+	}
+	result, err := r.q.ExecContext(ctx, "UPDATE idempotency_request set status = $1, header = $2, body = $3, expires_at = $4 where subject = $5 AND idempotency_key = $6",
+		request.Status, header, request.Body, request.ExpiresAt, request.Subject, request.Key)
+	return rowAffected(result, err)
+}
+
+func (r postgresIdempotencyRepository) Release(ctx context.Context, subject string, key string) error {
+	result, err := r.q.ExecContext(ctx, "DELETE FROM idempotency_request where subject = $1 AND idempotency_key = $2 AND status = 0", subject, key)
+	return rowAffected(result, err)
+}
+
+func (r postgresIdempotencyRepository) DeleteExpired(ctx context.Context, now time.Time) (int64, error) {
+	result, err := r.q.ExecContext(ctx, "DELETE FROM idempotency_request where expires_at <= $1", now)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// scanner is satisfied by both *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanAPIKey(row scanner) (APIKey, error) {
+	key := APIKey{}
+	scopes := pq.StringArray{}
+	err := row.Scan(&key.Id, &key.Name, &key.Prefix, &key.Hash, &scopes, &key.CreatedAt, &key.LastUsedAt, &key.RevokedAt)
+	key.Scopes = scopes
+	return key, err
+}
+
+// referencedError turns a foreign key violation on a delete into ErrReferenced
+func referencedError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+		return fmt.Errorf("%w: %s", ErrReferenced, pqErr.Message)
+	}
+	return err
+}
+
+// constraintError turns a unique violation on an insert or update into ErrDuplicate
+// and a foreign key violation into ErrMissingReference
+func constraintError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "23505":
+			return fmt.Errorf("%w: %s", ErrDuplicate, pqErr.Message)
+		case "23503":
+			return fmt.Errorf("%w: %s", ErrMissingReference, pqErr.Message)
+		}
+	}
+	return err
+}
+
+// rowAffected returns sql.ErrNoRows when a statement matched no row
+func rowAffected(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
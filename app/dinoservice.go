@@ -3,308 +3,533 @@ package app
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"jp/app/db"
-	"slices"
-	"strings"
-
-	validate "github.com/go-playground/validator/v10"
+	"time"
 )
 
 type DinoService interface {
-	GetDinos(ctx context.Context) ([]Dinosaur, error)
+	GetDinos(ctx context.Context, filter DinoFilter, page PageRequest) (Page[Dinosaur], error)
 	GetDinoById(ctx context.Context, dinoId int64) (Dinosaur, error)
 	GetCageById(ctx context.Context, cageId int64) (Cage, error)
-	GetDinosByCage(ctx context.Context, cageId int64) ([]Dinosaur, error)
-	AddDino(ctx context.Context, dino Dinosaur) error
-	UpdateDino(ctx context.Context, dino Dinosaur) error
-	GetCages(ctx context.Context) ([]Cage, error)
-	AddCage(ctx context.Context, cage Cage) error
-	UpdateCage(ctx context.Context, cage Cage) error
+	GetDinosByCage(ctx context.Context, cageId int64, page PageRequest) (Page[Dinosaur], error)
+	AddDino(ctx context.Context, dino Dinosaur) (Dinosaur, error)
+	UpdateDino(ctx context.Context, dino Dinosaur) (Dinosaur, error)
+	PatchDino(ctx context.Context, dinoId int64, patch json.RawMessage) (Dinosaur, error)
+	GetCages(ctx context.Context, filter CageFilter, page PageRequest) (Page[Cage], error)
+	AddCage(ctx context.Context, cage Cage) (Cage, error)
+	UpdateCage(ctx context.Context, cage Cage) (Cage, error)
+	PatchCage(ctx context.Context, cageId int64, patch json.RawMessage) (Cage, error)
+	EvacuateCage(ctx context.Context, cageId int64, dryRun bool) (RelocationPlan, error)
+	RelocateDinos(ctx context.Context, plan RelocationPlan) error
+	GetPlacementOptions(ctx context.Context, species string) (PlacementOptions, error)
+	GetDinoPlacementOptions(ctx context.Context, dinoId int64) (PlacementOptions, error)
+	DeleteDino(ctx context.Context, dinoId int64, archive bool) error
+	DeleteCage(ctx context.Context, cageId int64, archive bool) error
+	GetSpecies(ctx context.Context, page PageRequest) (Page[Species], error)
+	GetSpeciesByName(ctx context.Context, name string) (Species, error)
+	AddSpecies(ctx context.Context, species Species) (Species, error)
+	UpdateSpecies(ctx context.Context, species Species) (Species, error)
+	DeleteSpecies(ctx context.Context, name string) error
+	GetAuditEvents(ctx context.Context, filter AuditFilter, page PageRequest) (Page[AuditEvent], error)
+	GetDinoHistory(ctx context.Context, dinoId int64, page PageRequest) (Page[DinoPlacement], error)
+	GetCageOccupancy(ctx context.Context, cageId int64, at time.Time) (CageOccupancy, error)
+	CreateAPIKey(ctx context.Context, key NewAPIKey) (MintedAPIKey, error)
+	GetAPIKeys(ctx context.Context, page PageRequest) (Page[APIKey], error)
+	UpdateAPIKeyScopes(ctx context.Context, keyId int64, scopes APIKeyScopes) (APIKey, error)
+	RevokeAPIKey(ctx context.Context, keyId int64) error
 }
 
 type dinoServiceImpl struct {
 	dbService db.DbService
+	species   *speciesCache
+	events    *eventBroker
+	rules     ContainmentRules
+	policy    *PolicyStore
+	// idempotencyTTL is how long the responses to idempotent requests are kept
+	idempotencyTTL time.Duration
+	// idempotencyLease is how long the key of a request still being handled is held
+	idempotencyLease time.Duration
 }
 
-// NewDinoService return a new DinoService
+// NewDinoService return a new DinoService enforcing the DefaultContainmentRules
 func NewDinoService(db db.DbService) dinoServiceImpl {
+	return NewDinoServiceWithRules(db, DefaultContainmentRules())
+}
+
+// NewDinoServiceWithRules return a new DinoService enforcing the given rules, in order
+func NewDinoServiceWithRules(db db.DbService, rules ContainmentRules) dinoServiceImpl {
 	return dinoServiceImpl{
-		dbService: db,
+		dbService:        db,
+		species:          &speciesCache{},
+		events:           newEventBroker(),
+		rules:            rules,
+		idempotencyTTL:   DefaultIdempotencyTTL,
+		idempotencyLease: DefaultIdempotencyLease,
 	}
 }
 
-// GetDinos get all dinos regardless of cage
-func (s dinoServiceImpl) GetDinos(ctx context.Context) ([]Dinosaur, error) {
-	dinos := []Dinosaur{}
-	rows, err := s.
-		dbService.
-		GetConnection().
-		QueryContext(ctx, "SELECT id, dino_name, dino_species, cage_id FROM dinosaur ORDER BY ID ASC")
+// WithPolicy return the DinoService checking placements against the policy in the store
+func (s dinoServiceImpl) WithPolicy(policy *PolicyStore) dinoServiceImpl {
+	s.policy = policy
+	return s
+}
+
+// GetDinos get a page of dinos matching the filter, regardless of cage unless one is given
+func (s dinoServiceImpl) GetDinos(ctx context.Context, filter DinoFilter, page PageRequest) (Page[Dinosaur], error) {
+	v := newValidator()
+	err := v.Struct(filter)
 	if err != nil {
-		return dinos, err
+		return Page[Dinosaur]{}, validationFailed(err)
 	}
-	for rows.Next() {
-		var dino Dinosaur
-		err := rows.Scan(&dino.Id, &dino.Name, &dino.Species, &dino.CageId)
-		if err != nil {
-			return dinos, err
-		}
-		dinos = append(dinos, dino)
+	afterId, err := validatePageRequest(page)
+	if err != nil {
+		return Page[Dinosaur]{}, err
+	}
+
+	dbFilter := db.DinoFilter{
+		CageId:  filter.CageId,
+		Species: filter.Species,
+		Diet:    filter.Diet,
+		AfterId: afterId,
+		Limit:   page.limit() + 1,
 	}
-	return dinos, nil
+	dinos, err := s.dbService.Dinos().List(ctx, dbFilter)
+	if err != nil {
+		return Page[Dinosaur]{}, err
+	}
+	return newPage(dinos, page.limit(), func(d Dinosaur) int64 { return d.Id }), nil
 }
 
 // GetDinoById get a cage by id
 func (s dinoServiceImpl) GetDinoById(ctx context.Context, dinoId int64) (Dinosaur, error) {
-	dino := Dinosaur{}
-	row := s.dbService.GetConnection().QueryRowContext(ctx, "SELECT id, dino_name, cage_id, dino_species FROM dinosaur where id=$1", dinoId)
-	err := row.Scan(&dino.Id, &dino.Name, &dino.CageId, &dino.Species)
-	if err != nil {
-		return dino, err
-	}
-	return dino, nil
+	return s.dbService.Dinos().Get(ctx, dinoId)
 }
 
-// GetCageById get a cage by id
+// GetCageById get a cage by id along with its current occupancy
 func (s dinoServiceImpl) GetCageById(ctx context.Context, cageId int64) (Cage, error) {
-	cage := Cage{}
-	row := s.dbService.GetConnection().QueryRowContext(ctx, "SELECT id, cage_name, cage_status FROM cage where id=$1", cageId)
-	err := row.Scan(&cage.Id, &cage.Name, &cage.Status)
-	if err != nil {
-		return cage, err
-	}
-	return cage, nil
+	return s.dbService.Cages().Get(ctx, cageId)
 }
 
-// GetDinosByCage get all dinos in a cage
-func (s dinoServiceImpl) GetDinosByCage(ctx context.Context, cageId int64) ([]Dinosaur, error) {
-	dinos := []Dinosaur{}
-	rows, err := s.
-		dbService.
-		GetConnection().
-		QueryContext(ctx, "SELECT id, dino_name, dino_species, cage_id FROM dinosaur where cage_id = $1", cageId)
+// GetDinosByCage get a page of the dinos in a cage, an empty cage is not found
+func (s dinoServiceImpl) GetDinosByCage(ctx context.Context, cageId int64, page PageRequest) (Page[Dinosaur], error) {
+	afterId, err := validatePageRequest(page)
 	if err != nil {
-		return dinos, err
+		return Page[Dinosaur]{}, err
 	}
-	for rows.Next() {
-		var dino Dinosaur
-		err := rows.Scan(&dino.Id, &dino.Name, &dino.Species, &dino.CageId)
-		if err != nil {
-			return dinos, err
-		}
-		dinos = append(dinos, dino)
+	dinos, err := s.dbService.Dinos().List(ctx, db.DinoFilter{CageId: cageId, AfterId: afterId, Limit: page.limit() + 1})
+	if err != nil {
+		return Page[Dinosaur]{}, err
 	}
-	if len(dinos) == 0 {
-		return dinos, sql.ErrNoRows
+	if len(dinos) == 0 && afterId == 0 {
+		return Page[Dinosaur]{Items: dinos}, sql.ErrNoRows
 	}
-	return dinos, nil
+	return newPage(dinos, page.limit(), func(d Dinosaur) int64 { return d.Id }), nil
 
 }
 
-// AddDino add a new dinosaur
-func (s dinoServiceImpl) AddDino(ctx context.Context, dino Dinosaur) error {
+// AddDino add a new dinosaur, returning it as stored
+func (s dinoServiceImpl) AddDino(ctx context.Context, dino Dinosaur) (Dinosaur, error) {
 
-	v := validate.New()
+	v := newValidator()
 	err := v.Struct(dino)
 	if err != nil {
-		var errString strings.Builder
-		vErrors := err.(validate.ValidationErrors)
-		for _, validationError := range vErrors {
-			errString.WriteString(fmt.Sprintf("Invalid entry for %s. ", validationError.Field()))
-		}
-		return &ServiceRequestError{
-			err:      err.Error(),
-			response: errString.String(),
-		}
+		return Dinosaur{}, validationFailed(err)
 	}
 
-	// get the exising dinos in the cage and check if new dino is allowed
-	existingDinos, err := s.GetDinosByCage(ctx, dino.CageId)
-	if err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return err
+	catalogue, err := s.knownSpecies(ctx, dino.Species)
+	if err != nil {
+		return Dinosaur{}, err
 	}
 
-	if dinoIsAllowed(dino, existingDinos) {
-		_, err = s.dbService.
-			GetConnection().
-			ExecContext(ctx, "INSERT INTO dinosaur ( dino_name, dino_species, cage_id) VALUES ($1, $2, $3)", dino.Name, dino.Species, dino.CageId)
+	// the cage row stays locked until the insert commits so concurrent placements
+	// into the same cage are checked one at a time
+	var created Dinosaur
+	err = s.inTx(ctx, func(repos db.Repositories) error {
+		err := s.checkPlacement(ctx, repos, dino, 0, catalogue, s.policy.Current())
+		if err != nil {
+			return err
+		}
+		id, err := repos.Dinos().Create(ctx, dino)
 		if err != nil {
 			return err
 		}
-	} else {
-		return &ServiceRequestError{
-			err:      "error adding dinosaur to cage",
-			response: "This dinosaur is not allowed to be put in this cage",
+		err = repos.Placements().Move(ctx, id, dino.CageId)
+		if err != nil {
+			return err
 		}
+		created, err = repos.Dinos().Get(ctx, id)
+		if err != nil {
+			return err
+		}
+		err = publish(ctx, repos, EventDinosaurAdded, created)
+		if err != nil {
+			return err
+		}
+		return audit(ctx, repos, AuditCreate, AuditEntityDinosaur, id, nil, created)
+	})
+	if err != nil {
+		return Dinosaur{}, err
 	}
-
-	return nil
+	return created, nil
 }
 
-// UpdateDino updates a dinosaur
-func (s dinoServiceImpl) UpdateDino(ctx context.Context, dino Dinosaur) error {
+// UpdateDino updates a dinosaur, returning it as stored
+func (s dinoServiceImpl) UpdateDino(ctx context.Context, dino Dinosaur) (Dinosaur, error) {
 
-	v := validate.New()
+	v := newValidator()
 	err := v.Struct(dino)
 	if err != nil {
-		var errString strings.Builder
-		vErrors := err.(validate.ValidationErrors)
-		for _, validationError := range vErrors {
-			errString.WriteString(fmt.Sprintf("Invalid entry for %s. ", validationError.Field()))
-		}
-		return &ServiceRequestError{
-			err:      err.Error(),
-			response: errString.String(),
-		}
+		return Dinosaur{}, validationFailed(err)
 	}
 
-	// get the exising dinos for the cage_id and check if the dino is allowed
-	existingDinos, err := s.GetDinosByCage(ctx, dino.CageId)
-	if err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return err
+	catalogue, err := s.knownSpecies(ctx, dino.Species)
+	if err != nil {
+		return Dinosaur{}, err
 	}
 
-	if dinoIsAllowed(dino, existingDinos) {
-		query := `UPDATE dinosaur set 
-		dino_name = $1,
-		cage_id = $2
-		where id = $3`
-
-		_, err = s.
-			dbService.
-			GetConnection().
-			ExecContext(ctx, query, dino.Name, dino.CageId, dino.Id)
+	var updated Dinosaur
+	err = s.inTx(ctx, func(repos db.Repositories) error {
+		current, err := repos.Dinos().GetForUpdate(ctx, dino.Id)
 		if err != nil {
 			return err
 		}
-	} else {
-		return &ServiceRequestError{
-			err:      "error adding dinosaur to cage",
-			response: "This dinosaur is not allowed to be put in this cage",
+		err = checkIfMatch(ctx, dinoETag(current))
+		if err != nil {
+			return err
 		}
+		updated, err = s.updateDino(ctx, repos, current, dino, catalogue)
+		return err
+	})
+	if err != nil {
+		return Dinosaur{}, err
 	}
-
-	return nil
+	return updated, nil
 }
 
-// AddCage add a new cage
-func (s dinoServiceImpl) AddCage(ctx context.Context, cage Cage) error {
+// AddCage add a new cage, returning it as stored
+func (s dinoServiceImpl) AddCage(ctx context.Context, cage Cage) (Cage, error) {
 
-	v := validate.New()
+	v := newValidator()
 	err := v.Struct(cage)
 	if err != nil {
-		var errString strings.Builder
-		vErrors := err.(validate.ValidationErrors)
-		for _, validationError := range vErrors {
-			errString.WriteString(fmt.Sprintf("Invalid entry for %s. ", validationError.Field()))
-		}
-		return &ServiceRequestError{
-			err:      err.Error(),
-			response: errString.String(),
-		}
+		return Cage{}, validationFailed(err)
 	}
 
-	_, err = s.
-		dbService.
-		GetConnection().
-		ExecContext(ctx, "INSERT INTO cage ( cage_name, cage_status) VALUES ($1, $2)", cage.Name, cage.Status)
+	var created Cage
+	err = s.inTx(ctx, func(repos db.Repositories) error {
+		id, err := repos.Cages().Create(ctx, cage)
+		if errors.Is(err, db.ErrDuplicate) {
+			return cageNameTaken(err, cage)
+		}
+		if err != nil {
+			return err
+		}
+		created, err = repos.Cages().Get(ctx, id)
+		if err != nil {
+			return err
+		}
+		err = publish(ctx, repos, EventCageCreated, created)
+		if err != nil {
+			return err
+		}
+		return audit(ctx, repos, AuditCreate, AuditEntityCage, id, nil, created)
+	})
 	if err != nil {
-		return err
+		return Cage{}, err
 	}
-	return nil
+	return created, nil
 }
 
-// UpdateCage updates a cage
-func (s dinoServiceImpl) UpdateCage(ctx context.Context, cage Cage) error {
+// UpdateCage updates a cage, returning it as stored
+func (s dinoServiceImpl) UpdateCage(ctx context.Context, cage Cage) (Cage, error) {
 
-	v := validate.New()
+	v := newValidator()
 	err := v.Struct(cage)
 	if err != nil {
-		var errString strings.Builder
-		vErrors := err.(validate.ValidationErrors)
-		for _, validationError := range vErrors {
-			errString.WriteString(fmt.Sprintf("Invalid entry for %s. ", validationError.Field()))
+		return Cage{}, validationFailed(err)
+	}
+
+	var updated Cage
+	err = s.inTx(ctx, func(repos db.Repositories) error {
+		current, err := repos.Cages().GetForUpdate(ctx, cage.Id)
+		if err != nil {
+			return err
 		}
-		return &ServiceRequestError{
-			err:      err.Error(),
-			response: errString.String(),
+		err = checkIfMatch(ctx, cageETag(current))
+		if err != nil {
+			return err
 		}
+		updated, err = saveCage(ctx, repos, current, cage)
+		return err
+	})
+	if err != nil {
+		return Cage{}, err
 	}
+	return updated, nil
+}
 
-	query := `UPDATE cage set 
-		cage_status = $1,
-		cage_name = $2
-		where id = $3`
+// GetCages get a page of the cages matching the filter
+func (s dinoServiceImpl) GetCages(ctx context.Context, filter CageFilter, page PageRequest) (Page[Cage], error) {
+	v := newValidator()
+	err := v.Struct(filter)
+	if err != nil {
+		return Page[Cage]{}, validationFailed(err)
+	}
+	filter.AfterId, err = validatePageRequest(page)
+	if err != nil {
+		return Page[Cage]{}, err
+	}
+	filter.Limit = page.limit() + 1
 
-	_, err = s.dbService.GetConnection().ExecContext(ctx, query, cage.Status, cage.Name, cage.Id)
+	cages, err := s.dbService.Cages().List(ctx, filter)
 	if err != nil {
-		return err
+		return Page[Cage]{}, err
 	}
+	return newPage(cages, page.limit(), func(c Cage) int64 { return c.Id }), nil
+}
+
+// DeleteDino removes a dinosaur, when archive is set the row is kept for history instead
+func (s dinoServiceImpl) DeleteDino(ctx context.Context, dinoId int64, archive bool) error {
+	return s.inTx(ctx, func(repos db.Repositories) error {
+		dino, err := repos.Dinos().GetForUpdate(ctx, dinoId)
+		if err != nil {
+			return err
+		}
+		err = checkIfMatch(ctx, dinoETag(dino))
+		if err != nil {
+			return err
+		}
+		// the dino has left the park, its history is kept either way
+		err = repos.Placements().End(ctx, dinoId)
+		if err != nil {
+			return err
+		}
+		err = publish(ctx, repos, EventDinosaurRemoved, DinosaurRemoved{Dinosaur: dino, Archived: archive})
+		if err != nil {
+			return err
+		}
+		if archive {
+			err = repos.Dinos().Archive(ctx, dinoId)
+			if err != nil {
+				return err
+			}
+			return audit(ctx, repos, AuditArchive, AuditEntityDinosaur, dinoId, dino, nil)
+		}
+		err = repos.Dinos().Delete(ctx, dinoId)
+		if err != nil {
+			return err
+		}
+		return audit(ctx, repos, AuditDelete, AuditEntityDinosaur, dinoId, dino, nil)
+	})
+}
+
+// DeleteCage removes an empty cage, when archive is set the row is kept for history instead
+func (s dinoServiceImpl) DeleteCage(ctx context.Context, cageId int64, archive bool) error {
+	return s.inTx(ctx, func(repos db.Repositories) error {
+		cage, err := repos.Cages().GetForUpdate(ctx, cageId)
+		if err != nil {
+			return err
+		}
+		err = checkIfMatch(ctx, cageETag(cage))
+		if err != nil {
+			return err
+		}
+		if cage.Occupancy > 0 {
+			return &ServiceRequestError{
+				err:      fmt.Sprintf("cage %d is not empty", cageId),
+				response: fmt.Sprintf("This cage holds %d dinosaurs, it cannot be deleted until they are moved out", cage.Occupancy),
+				code:     CodeCageNotEmpty,
+			}
+		}
+		err = publish(ctx, repos, EventCageRemoved, cage)
+		if err != nil {
+			return err
+		}
+		if archive {
+			err = repos.Cages().Archive(ctx, cageId)
+			if err != nil {
+				return err
+			}
+			return audit(ctx, repos, AuditArchive, AuditEntityCage, cageId, cage, nil)
+		}
+
+		err = repos.Cages().Delete(ctx, cageId)
+		if errors.Is(err, db.ErrReferenced) {
+			return &ServiceRequestError{
+				err:      err.Error(),
+				response: "This cage still has archived dinosaurs recorded against it, archive the cage instead",
+				code:     CodeCageNotEmpty,
+			}
+		}
+		if err != nil {
+			return err
+		}
+		return audit(ctx, repos, AuditDelete, AuditEntityCage, cageId, cage, nil)
+	})
+}
+
+// updateDino applies a dino update inside a transaction, current is the dino as it was locked and its target
+// cage is locked too so the rule check cannot interleave with another placement into the same cage
+func (s dinoServiceImpl) updateDino(ctx context.Context, repos db.Repositories, current Dinosaur, dino Dinosaur, catalogue map[string]Species) (Dinosaur, error) {
+	// the species of a dino never changes, the rules must see the stored one
+	dino.Species = current.Species
 
-	return nil
+	err := s.checkPlacement(ctx, repos, dino, current.CageId, catalogue, s.policy.Current())
+	if err != nil {
+		return Dinosaur{}, err
+	}
+	return saveDino(ctx, repos, current, dino)
 }
 
-// GetCages get all cages
-func (s dinoServiceImpl) GetCages(ctx context.Context) ([]Cage, error) {
-	cages := []Cage{}
-	rows, err := s.
-		dbService.
-		GetConnection().
-		QueryContext(ctx, "SELECT id, cage_name, cage_status FROM cage")
+// saveDino writes a dino update and records it in the audit log, and in the placement history when it changes cage
+func saveDino(ctx context.Context, repos db.Repositories, before Dinosaur, dino Dinosaur) (Dinosaur, error) {
+	err := repos.Dinos().Update(ctx, dino)
+	if err != nil {
+		return Dinosaur{}, err
+	}
+	if dino.CageId != before.CageId {
+		err = repos.Placements().Move(ctx, dino.Id, dino.CageId)
+		if err != nil {
+			return Dinosaur{}, err
+		}
+	}
+	updated, err := repos.Dinos().Get(ctx, dino.Id)
 	if err != nil {
-		return cages, err
+		return Dinosaur{}, err
 	}
-	for rows.Next() {
-		var cage Cage
-		err := rows.Scan(&cage.Id, &cage.Name, &cage.Status)
+	if updated.CageId != before.CageId {
+		err = publish(ctx, repos, EventDinosaurMoved, DinosaurMoved{Dinosaur: updated, FromCageId: before.CageId, ToCageId: updated.CageId})
 		if err != nil {
-			return cages, err
+			return Dinosaur{}, err
 		}
-		cages = append(cages, cage)
 	}
-	return cages, nil
+	return updated, audit(ctx, repos, AuditUpdate, AuditEntityDinosaur, dino.Id, before, updated)
 }
 
-/*
-dinoIsAllowed rules:
-- carnivores can only be in same cage as same species
-- herbivores cannot be in same cage as carnivores
-*/
-func dinoIsAllowed(newDino Dinosaur, currentDinos []Dinosaur) bool {
+// checkPlacement locks the target cage and runs the containment rules against its occupants,
+// policy is the compatibility policy in force when the change began
+func (s dinoServiceImpl) checkPlacement(ctx context.Context, repos db.Repositories, dino Dinosaur, from int64, catalogue map[string]Species, policy *Policy) error {
+	cage, err := getTargetCage(ctx, repos, dino.CageId)
+	if err != nil {
+		return err
+	}
 
-	if len(currentDinos) == 0 {
-		return true
+	dinos, err := repos.Dinos().ListByCage(ctx, dino.CageId)
+	if err != nil {
+		return err
+	}
+	occupants := make([]Dinosaur, 0, len(dinos))
+	for _, occupant := range dinos {
+		if occupant.Id != dino.Id {
+			occupants = append(occupants, occupant)
+		}
+	}
+
+	return placementError(s.rules.Check(Placement{
+		Dino:      dino,
+		From:      from,
+		Cage:      cage,
+		Occupants: occupants,
+		Species:   catalogue,
+		Policy:    policy,
+	}))
+}
+
+// saveCage writes a cage update and records it in the audit log, current is the cage as it was locked
+func saveCage(ctx context.Context, repos db.Repositories, current Cage, cage Cage) (Cage, error) {
+	// the capacity cannot be lowered below the number of dinos already in the cage
+	if cage.MaxCapacity < current.Occupancy {
+		return Cage{}, &ServiceRequestError{
+			err:      "error updating cage capacity",
+			response: fmt.Sprintf("This cage holds %d dinosaurs, max_capacity cannot be lower than that", current.Occupancy),
+			code:     CodeCapacityExceeded,
+		}
 	}
 
-	carnivores := []string{"Tyrannosaurus", "Velociraptor", "Spinosaurus", "Megalosaurus"}
+	// powering down an occupied cage would leave dinos without power, they have to be evacuated first
+	if cage.Status == CageStatusDown && current.Status != CageStatusDown && current.Occupancy > 0 {
+		return Cage{}, &ServiceRequestError{
+			err:      fmt.Sprintf("cage %d is not empty", cage.Id),
+			response: fmt.Sprintf("This cage holds %d dinosaurs, evacuate it to power it down", current.Occupancy),
+			code:     CodeCageNotEmpty,
+		}
+	}
 
-	newDinoIsCarn := false
-	currentDinosAreCarn := false
+	err := repos.Cages().Update(ctx, cage)
+	if errors.Is(err, db.ErrDuplicate) {
+		return Cage{}, cageNameTaken(err, cage)
+	}
+	if err != nil {
+		return Cage{}, err
+	}
+	updated, err := repos.Cages().Get(ctx, cage.Id)
+	if err != nil {
+		return Cage{}, err
+	}
+	if updated.Status != current.Status {
+		err = publish(ctx, repos, EventCageStatusChanged, CageStatusChanged{Cage: updated, From: current.Status, To: updated.Status})
+		if err != nil {
+			return Cage{}, err
+		}
+	}
+	return updated, audit(ctx, repos, AuditUpdate, AuditEntityCage, cage.Id, current, updated)
+}
 
-	if slices.Contains(carnivores, newDino.Species) {
-		newDinoIsCarn = true
+// cageNameTaken is the error for a cage named like another one
+func cageNameTaken(err error, cage Cage) error {
+	return &ServiceRequestError{
+		err:      err.Error(),
+		response: fmt.Sprintf("There is already a cage named %s", cage.Name),
+		code:     CodeConflict,
 	}
+}
 
-	// we can compare the new dino to just one example in the cage
-	existingDino := currentDinos[0]
-	if slices.Contains(carnivores, existingDino.Species) {
-		currentDinosAreCarn = true
+// getTargetCage locks the cage a dino is being placed in, a missing cage is a bad request
+func getTargetCage(ctx context.Context, repos db.Repositories, cageId int64) (Cage, error) {
+	cage, err := repos.Cages().GetForUpdate(ctx, cageId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return cage, &ServiceRequestError{
+			err:      fmt.Sprintf("cage %d does not exist", cageId),
+			response: "The requested cage does not exist",
+			code:     CodeCageNotFound,
+		}
 	}
+	return cage, err
+}
 
-	if newDinoIsCarn && currentDinosAreCarn {
-		return newDino.Species == existingDino.Species
-	} else if !newDinoIsCarn && !currentDinosAreCarn {
-		return true
-	} else {
-		return false
+// validatePageRequest checks the page size and returns the id the cursor points after
+func validatePageRequest(page PageRequest) (int64, error) {
+	v := newValidator()
+	err := v.Struct(page)
+	if err != nil {
+		return 0, validationFailed(err)
+	}
+	afterId, err := decodeCursor(page.Cursor)
+	if err != nil {
+		return 0, &ServiceRequestError{
+			err:      err.Error(),
+			response: "Invalid entry for cursor. ",
+			code:     CodeValidationFailed,
+			fields:   []FieldError{{Field: "cursor", Rule: "cursor"}},
+		}
 	}
+	return afterId, nil
 }
 
 type ServiceRequestError struct {
 	err      string
 	response string
+	// code is the ErrorCode the client is given
+	code ErrorCode
+	// fields lists the fields that failed validation
+	fields []FieldError
+	// violations lists the containment rules a placement broke
+	violations []RuleViolation
+	// relocations lists the refused moves of a relocation plan
+	relocations []RelocationFailure
 }
 
 func (s ServiceRequestError) Error() string {
@@ -2,34 +2,40 @@ package app
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
 	"jp/app/db"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
-// These tests work using a localhost db
+// These tests work using the in-memory db, seeded like sql/create_tables.sql
 func Test_Add_Cage_and_Dino(t *testing.T) {
 
 	ctx := context.Background()
 
 	asserter := assert.New(t)
 
-	client, err := getClient()
-	asserter.NoError(err)
+	client := getClient()
 
 	dinoService := NewDinoService(client)
 
 	cage := Cage{
-		Name:   "test_cage",
-		Status: "ACTIVE",
+		Name:        "test_cage",
+		Status:      "ACTIVE",
+		MaxCapacity: 1,
 	}
-	err = dinoService.AddCage(ctx, cage)
+	_, err := dinoService.AddCage(ctx, cage)
 	asserter.NoError(err)
 
-	var testCageId int64
-	row := client.GetConnection().QueryRowContext(ctx, "select id from cage where cage_name = 'test_cage'")
-	row.Scan(&testCageId)
+	testCageId := getCageId(t, dinoService, "test_cage")
 
 	dino := Dinosaur{
 		CageId:  testCageId,
@@ -37,24 +43,986 @@ func Test_Add_Cage_and_Dino(t *testing.T) {
 		Species: "Brachiosaurus",
 	}
 
-	err = dinoService.AddDino(ctx, dino)
+	_, err = dinoService.AddDino(ctx, dino)
+	asserter.NoError(err)
+
+	dinos, err := dinoService.GetDinosByCage(ctx, testCageId, PageRequest{})
+	asserter.NoError(err)
+	asserter.Equal("test_dino", dinos.Items[0].Name)
+	asserter.Equal(testCageId, dinos.Items[0].CageId)
+	asserter.Equal("Brachiosaurus", dinos.Items[0].Species)
+
+	cage, err = dinoService.GetCageById(ctx, testCageId)
+	asserter.NoError(err)
+	asserter.Equal(int64(1), cage.Occupancy)
+	asserter.Equal(int64(0), cage.RemainingSlots)
+
+	// the cage is full so a second dino is refused
+	_, err = dinoService.AddDino(ctx, Dinosaur{
+		CageId:  testCageId,
+		Name:    "test_dino_two",
+		Species: "Brachiosaurus",
+	})
+	var serviceErr *ServiceRequestError
+	asserter.ErrorAs(err, &serviceErr)
+}
+
+func Test_Down_Cage_Refuses_Dinos(t *testing.T) {
+
+	ctx := context.Background()
+
+	asserter := assert.New(t)
+
+	dinoService := NewDinoService(getClient())
+
+	_, err := dinoService.AddCage(ctx, Cage{
+		Name:        "test_down_cage",
+		Status:      CageStatusDown,
+		MaxCapacity: 2,
+	})
+	asserter.NoError(err)
+
+	testCageId := getCageId(t, dinoService, "test_down_cage")
+
+	_, err = dinoService.AddDino(ctx, Dinosaur{
+		CageId:  testCageId,
+		Name:    "test_dino",
+		Species: "Brachiosaurus",
+	})
+	var serviceErr *ServiceRequestError
+	asserter.ErrorAs(err, &serviceErr)
+}
+
+func Test_Concurrent_Placement_Into_Empty_Cage(t *testing.T) {
+	testConcurrentPlacement(t, getClient())
+}
+
+// the memory store runs one transaction at a time, only postgres shows the cage row lock doing its job
+func Test_Concurrent_Placement_Into_Empty_Cage_Postgres(t *testing.T) {
+	dsn := os.Getenv("TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("TEST_POSTGRES_DSN is not set")
+	}
+	dbService, err := db.OpenDbService(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbService.Close()
+	testConcurrentPlacement(t, dbService)
+}
+
+func testConcurrentPlacement(t *testing.T, dbService db.DbService) {
+
+	ctx := context.Background()
+
+	asserter := assert.New(t)
+
+	dinoService := NewDinoService(dbService)
+
+	// the name is unique so the test can run again against the same database
+	cage, err := dinoService.AddCage(ctx, Cage{
+		Name:        fmt.Sprintf("test_race_cage_%d", time.Now().UnixNano()),
+		Status:      CageStatusActive,
+		MaxCapacity: 5,
+	})
+	asserter.NoError(err)
+
+	testCageId := cage.Id
+
+	// half the requests race a carnivore in and half a herbivore, only one diet may win
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		species := "Velociraptor"
+		if i%2 == 0 {
+			species = "Brachiosaurus"
+		}
+		wg.Add(1)
+		go func(i int, species string) {
+			defer wg.Done()
+			dinoService.AddDino(ctx, Dinosaur{
+				CageId:  testCageId,
+				Name:    fmt.Sprintf("test_race_dino_%d", i),
+				Species: species,
+			})
+		}(i, species)
+	}
+	wg.Wait()
+
+	dinos, err := dinoService.GetDinosByCage(ctx, testCageId, PageRequest{})
+	asserter.NoError(err)
+	asserter.Len(dinos.Items, 5)
+	for _, dino := range dinos.Items {
+		asserter.Equal(dinos.Items[0].Species, dino.Species)
+	}
+
+	for _, dino := range dinos.Items {
+		asserter.NoError(dinoService.DeleteDino(ctx, dino.Id, true))
+	}
+	asserter.NoError(dinoService.DeleteCage(ctx, testCageId, true))
+}
+
+func Test_Containment_Rules(t *testing.T) {
+
+	ctx := context.Background()
+
+	asserter := assert.New(t)
+
+	dinoService := NewDinoService(getClient())
+
+	// Cage One holds two Tyrannosaurus, Cage Two holds herbivores
+	var serviceErr *ServiceRequestError
+
+	// carnivores only share with their own species
+	_, err := dinoService.AddDino(ctx, Dinosaur{CageId: 1, Name: "Blue", Species: "Velociraptor"})
+	asserter.ErrorAs(err, &serviceErr)
+
+	// carnivores and herbivores never share
+	_, err = dinoService.AddDino(ctx, Dinosaur{CageId: 1, Name: "Cera", Species: "Triceratops"})
+	asserter.ErrorAs(err, &serviceErr)
+
+	_, err = dinoService.AddDino(ctx, Dinosaur{CageId: 1, Name: "Rexy", Species: "Tyrannosaurus"})
+	asserter.NoError(err)
+
+	// moving a herbivore in with the carnivores is refused too
+	_, err = dinoService.UpdateDino(ctx, Dinosaur{Id: 3, CageId: 1, Name: "Bart", Species: "Brachiosaurus"})
+	asserter.ErrorAs(err, &serviceErr)
+
+	dino, err := dinoService.GetDinoById(ctx, 3)
+	asserter.NoError(err)
+	asserter.Equal(int64(2), dino.CageId)
+}
+
+func Test_Delete_Dino_and_Cage(t *testing.T) {
+
+	ctx := context.Background()
+
+	asserter := assert.New(t)
+
+	dinoService := NewDinoService(getClient())
+
+	// Cage One still holds Maggie and Lisa
+	var serviceErr *ServiceRequestError
+	err := dinoService.DeleteCage(ctx, 1, false)
+	asserter.ErrorAs(err, &serviceErr)
+
+	err = dinoService.DeleteDino(ctx, 1, true)
+	asserter.NoError(err)
+	err = dinoService.DeleteDino(ctx, 2, false)
+	asserter.NoError(err)
+
+	_, err = dinoService.GetDinoById(ctx, 1)
+	asserter.ErrorIs(err, sql.ErrNoRows)
+	err = dinoService.DeleteDino(ctx, 1, false)
+	asserter.ErrorIs(err, sql.ErrNoRows)
+
+	// archived Maggie still references the cage so it can only be archived
+	err = dinoService.DeleteCage(ctx, 1, false)
+	asserter.ErrorAs(err, &serviceErr)
+	err = dinoService.DeleteCage(ctx, 1, true)
+	asserter.NoError(err)
+
+	_, err = dinoService.GetCageById(ctx, 1)
+	asserter.ErrorIs(err, sql.ErrNoRows)
+}
+
+func Test_Filter_Dinos_and_Cages(t *testing.T) {
+
+	ctx := context.Background()
+
+	asserter := assert.New(t)
+
+	dinoService := NewDinoService(getClient())
+
+	dinos, err := dinoService.GetDinos(ctx, DinoFilter{Diet: DietCarnivore}, PageRequest{})
+	asserter.NoError(err)
+	asserter.Len(dinos.Items, 2)
+
+	dinos, err = dinoService.GetDinos(ctx, DinoFilter{Diet: DietHerbivore, CageId: 2}, PageRequest{})
+	asserter.NoError(err)
+	asserter.Len(dinos.Items, 3)
+
+	dinos, err = dinoService.GetDinos(ctx, DinoFilter{Species: "Stegosaurus"}, PageRequest{})
+	asserter.NoError(err)
+	asserter.Len(dinos.Items, 1)
+	asserter.Equal("Homer", dinos.Items[0].Name)
+
+	// a species outside the diet matches nothing
+	dinos, err = dinoService.GetDinos(ctx, DinoFilter{Species: "Stegosaurus", Diet: DietCarnivore}, PageRequest{})
+	asserter.NoError(err)
+	asserter.Empty(dinos.Items)
+
+	var serviceErr *ServiceRequestError
+	_, err = dinoService.GetDinos(ctx, DinoFilter{Diet: "omnivore"}, PageRequest{})
+	asserter.ErrorAs(err, &serviceErr)
+	asserter.Equal([]FieldError{{Field: "diet", Rule: "oneof", Param: "carnivore herbivore"}}, serviceErr.fields)
+
+	_, err = dinoService.AddCage(ctx, Cage{Name: "test_down_cage", Status: CageStatusDown, MaxCapacity: 1})
+	asserter.NoError(err)
+
+	cages, err := dinoService.GetCages(ctx, CageFilter{Status: CageStatusDown}, PageRequest{})
+	asserter.NoError(err)
+	asserter.Len(cages.Items, 1)
+	asserter.Equal("test_down_cage", cages.Items[0].Name)
+
+	_, err = dinoService.GetCages(ctx, CageFilter{Status: "BROKEN"}, PageRequest{})
+	asserter.ErrorAs(err, &serviceErr)
+	asserter.Equal([]FieldError{{Field: "status", Rule: "oneof", Param: "ACTIVE DOWN"}}, serviceErr.fields)
+	asserter.Contains(serviceErr.response, "Status")
+}
+
+func Test_Paginate_Dinos(t *testing.T) {
+
+	ctx := context.Background()
+
+	asserter := assert.New(t)
+
+	dinoService := NewDinoService(getClient())
+
+	// the five seed dinos come back two at a time
+	names := []string{}
+	page := PageRequest{Limit: 2}
+	for i := 0; i < 3; i++ {
+		dinos, err := dinoService.GetDinos(ctx, DinoFilter{}, page)
+		asserter.NoError(err)
+		for _, dino := range dinos.Items {
+			names = append(names, dino.Name)
+		}
+		page.Cursor = dinos.NextCursor
+	}
+	asserter.Equal([]string{"Maggie", "Lisa", "Bart", "Homer", "Marge"}, names)
+	asserter.Empty(page.Cursor)
+
+	var serviceErr *ServiceRequestError
+	_, err := dinoService.GetDinos(ctx, DinoFilter{}, PageRequest{Cursor: "not-a-cursor"})
+	asserter.ErrorAs(err, &serviceErr)
+	asserter.Equal([]FieldError{{Field: "cursor", Rule: "cursor"}}, serviceErr.fields)
+	_, err = dinoService.GetCages(ctx, CageFilter{}, PageRequest{Limit: maxPageLimit + 1})
+	asserter.ErrorAs(err, &serviceErr)
+	asserter.Equal([]FieldError{{Field: "limit", Rule: "lte", Param: "500"}}, serviceErr.fields)
+}
+
+func Test_Species_Registry(t *testing.T) {
+
+	ctx := context.Background()
+
+	asserter := assert.New(t)
+
+	dinoService := NewDinoService(getClient())
+
+	_, err := dinoService.AddCage(ctx, Cage{Name: "test_cage", Status: CageStatusActive, MaxCapacity: 2})
+	asserter.NoError(err)
+	testCageId := getCageId(t, dinoService, "test_cage")
+
+	// unknown until it is registered, which also refreshes the cached species
+	var serviceErr *ServiceRequestError
+	dilo := Dinosaur{CageId: testCageId, Name: "Spitter", Species: "Dilophosaurus"}
+	_, err = dinoService.AddDino(ctx, dilo)
+	asserter.ErrorAs(err, &serviceErr)
+
+	_, err = dinoService.AddSpecies(ctx, Species{Name: "Dilophosaurus", Diet: DietCarnivore})
+	asserter.NoError(err)
+	_, err = dinoService.AddDino(ctx, dilo)
+	asserter.NoError(err)
+
+	// the new carnivore keeps other species out
+	_, err = dinoService.AddDino(ctx, Dinosaur{CageId: testCageId, Name: "Blue", Species: "Velociraptor"})
+	asserter.ErrorAs(err, &serviceErr)
+
+	dinos, err := dinoService.GetDinos(ctx, DinoFilter{Diet: DietCarnivore}, PageRequest{})
+	asserter.NoError(err)
+	asserter.Len(dinos.Items, 3)
+
+	// the diet of a species in the park is fixed, and it cannot be deleted
+	_, err = dinoService.UpdateSpecies(ctx, Species{Name: "Dilophosaurus", Diet: DietHerbivore})
+	asserter.ErrorAs(err, &serviceErr)
+	err = dinoService.DeleteSpecies(ctx, "Dilophosaurus")
+	asserter.ErrorAs(err, &serviceErr)
+
+	_, err = dinoService.UpdateSpecies(ctx, Species{Name: "Triceratops", Diet: DietCarnivore})
+	asserter.NoError(err)
+	species, err := dinoService.GetSpeciesByName(ctx, "Triceratops")
+	asserter.NoError(err)
+	asserter.Equal(DietCarnivore, species.Diet)
+
+	err = dinoService.DeleteSpecies(ctx, "Megalosaurus")
+	asserter.NoError(err)
+	_, err = dinoService.GetSpeciesByName(ctx, "Megalosaurus")
+	asserter.ErrorIs(err, sql.ErrNoRows)
+}
+
+func Test_Every_Violated_Rule_Is_Reported(t *testing.T) {
+
+	ctx := context.Background()
+
+	asserter := assert.New(t)
+
+	dinoService := NewDinoService(getClient())
+
+	_, err := dinoService.AddCage(ctx, Cage{Name: "test_cage", Status: CageStatusActive, MaxCapacity: 1})
+	asserter.NoError(err)
+	testCageId := getCageId(t, dinoService, "test_cage")
+	_, err = dinoService.AddDino(ctx, Dinosaur{CageId: testCageId, Name: "Blue", Species: "Velociraptor"})
+	asserter.NoError(err)
+
+	// a Tyrannosaurus is the wrong species and the cage is full
+	_, err = dinoService.AddDino(ctx, Dinosaur{CageId: testCageId, Name: "Rexy", Species: "Tyrannosaurus"})
+	var serviceErr *ServiceRequestError
+	asserter.ErrorAs(err, &serviceErr)
+	rules := []string{}
+	for _, violation := range serviceErr.violations {
+		rules = append(rules, violation.Rule)
+	}
+	asserter.Equal([]string{"cage_capacity", "carnivore_same_species"}, rules)
+}
+
+func Test_Custom_Containment_Rule(t *testing.T) {
+
+	ctx := context.Background()
+
+	asserter := assert.New(t)
+
+	rules := append(DefaultContainmentRules(), noStegosaurusRule{})
+	dinoService := NewDinoServiceWithRules(getClient(), rules)
+
+	_, err := dinoService.AddDino(ctx, Dinosaur{CageId: 2, Name: "Spike", Species: "Stegosaurus"})
+	var serviceErr *ServiceRequestError
+	asserter.ErrorAs(err, &serviceErr)
+	asserter.Equal("no_stegosaurus", serviceErr.violations[0].Rule)
+
+	_, err = dinoService.AddDino(ctx, Dinosaur{CageId: 2, Name: "Cera", Species: "Triceratops"})
+	asserter.NoError(err)
+}
+
+func Test_Policy_File(t *testing.T) {
+
+	ctx := context.Background()
+
+	asserter := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	writePolicy(t, path, `
+allowed_pairs:
+  - [Velociraptor, Tyrannosaurus]
+max_group_size:
+  Tyrannosaurus: 2
+forbidden_pairs:
+  - [Triceratops, Stegosaurus]
+`)
+	dinoService := NewDinoService(getClient())
+	policy, err := NewPolicyStore(ctx, path, dinoService)
+	asserter.NoError(err)
+	dinoService = dinoService.WithPolicy(policy)
+
+	// Cage One holds Maggie and Lisa the Tyrannosaurus
+	_, err = dinoService.AddDino(ctx, Dinosaur{CageId: 1, Name: "Blue", Species: "Velociraptor"})
+	asserter.NoError(err)
+	_, err = dinoService.AddDino(ctx, Dinosaur{CageId: 1, Name: "Rexy", Species: "Tyrannosaurus"})
+	var serviceErr *ServiceRequestError
+	asserter.ErrorAs(err, &serviceErr)
+	asserter.Equal("policy_group_size", serviceErr.violations[0].Rule)
+
+	// Cage Two holds Homer the Stegosaurus
+	_, err = dinoService.AddDino(ctx, Dinosaur{CageId: 2, Name: "Cera", Species: "Triceratops"})
+	asserter.ErrorAs(err, &serviceErr)
+	asserter.Equal("policy_forbidden_pair", serviceErr.violations[0].Rule)
+
+	// an invalid file is rejected by line and the policy in force is kept
+	writePolicy(t, path, `
+allowed_pairs:
+  - [Velociraptor]
+max_group_size:
+  Tyrannosaurus: none
+forbidden_pairs:
+  - [Triceratops, Stegosaurus]
+colour: green
+`)
+	err = policy.Reload(ctx)
+	var policyErr *PolicyError
+	asserter.ErrorAs(err, &policyErr)
+	lines := []int{}
+	for _, lineErr := range policyErr.Errors {
+		lines = append(lines, lineErr.Line)
+	}
+	asserter.Equal([]int{3, 5, 8}, lines)
+	_, err = dinoService.AddDino(ctx, Dinosaur{CageId: 2, Name: "Cera", Species: "Triceratops"})
+	asserter.ErrorAs(err, &serviceErr)
+
+	// a misspelt species would make a rule that never applies
+	writePolicy(t, path, `
+max_group_size:
+  Tyrannosaurus: 2
+forbidden_pairs:
+  - [Velociraptr, Stegosaurus]
+`)
+	err = policy.Reload(ctx)
+	asserter.ErrorAs(err, &policyErr)
+	asserter.Equal([]PolicyLineError{{Line: 5, Message: "unknown species Velociraptr"}}, policyErr.Errors)
+	_, err = dinoService.AddDino(ctx, Dinosaur{CageId: 2, Name: "Cera", Species: "Triceratops"})
+	asserter.ErrorAs(err, &serviceErr)
+	_, err = NewPolicyStore(ctx, path, dinoService)
+	asserter.ErrorAs(err, &policyErr)
+
+	// without the forbidden pair Triceratops can join the herbivores
+	writePolicy(t, path, `{"max_group_size": {"Tyrannosaurus": 2}}`)
+	asserter.NoError(policy.Reload(ctx))
+	_, err = dinoService.AddDino(ctx, Dinosaur{CageId: 2, Name: "Cera", Species: "Triceratops"})
+	asserter.NoError(err)
+}
+
+func Test_Relocate_Dinos(t *testing.T) {
+
+	ctx := context.Background()
+
+	asserter := assert.New(t)
+
+	dinoService := NewDinoService(getClient())
+
+	_, err := dinoService.AddCage(ctx, Cage{Name: "repair_cage", Status: CageStatusActive, MaxCapacity: 2})
+	asserter.NoError(err)
+	repairCageId := getCageId(t, dinoService, "repair_cage")
+
+	// Bart the Brachiosaurus cannot join Maggie and Lisa before they have left Cage One,
+	// and there is no dino 99, so nothing is moved
+	bart, maggie, lisa := int64(3), int64(1), int64(2)
+	err = dinoService.RelocateDinos(ctx, RelocationPlan{Moves: []Relocation{
+		{DinoId: bart, TargetCageId: 1},
+		{DinoId: maggie, TargetCageId: repairCageId},
+		{DinoId: lisa, TargetCageId: repairCageId},
+		{DinoId: 99, TargetCageId: repairCageId},
+	}})
+	var serviceErr *ServiceRequestError
+	asserter.ErrorAs(err, &serviceErr)
+	asserter.Len(serviceErr.relocations, 2)
+	asserter.Equal(0, serviceErr.relocations[0].Move)
+	asserter.Equal("diet_separation", serviceErr.relocations[0].Violations[0].Rule)
+	asserter.Equal(3, serviceErr.relocations[1].Move)
+	asserter.Equal("The dinosaur does not exist", serviceErr.relocations[1].Reason)
+	dino, err := dinoService.GetDinoById(ctx, maggie)
+	asserter.NoError(err)
+	asserter.Equal(int64(1), dino.CageId)
+
+	// once the Tyrannosaurus have moved out Bart can move in
+	err = dinoService.RelocateDinos(ctx, RelocationPlan{Moves: []Relocation{
+		{DinoId: maggie, TargetCageId: repairCageId},
+		{DinoId: lisa, TargetCageId: repairCageId},
+		{DinoId: bart, TargetCageId: 1},
+	}})
+	asserter.NoError(err)
+	dinos, err := dinoService.GetDinosByCage(ctx, repairCageId, PageRequest{})
+	asserter.NoError(err)
+	asserter.Len(dinos.Items, 2)
+	dino, err = dinoService.GetDinoById(ctx, bart)
+	asserter.NoError(err)
+	asserter.Equal(int64(1), dino.CageId)
+
+	err = dinoService.RelocateDinos(ctx, RelocationPlan{})
+	asserter.ErrorAs(err, &serviceErr)
+}
+
+func Test_Evacuate_Cage(t *testing.T) {
+
+	ctx := context.Background()
+
+	asserter := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	writePolicy(t, path, "forbidden_pairs: [[Triceratops, Stegosaurus]]")
+	dinoService := NewDinoService(getClient())
+	policy, err := NewPolicyStore(ctx, path, dinoService)
+	asserter.NoError(err)
+	dinoService = dinoService.WithPolicy(policy)
+
+	// Cage Two is left full so only the new cages can take the evacuated dinos
+	_, err = dinoService.UpdateCage(ctx, Cage{Id: 2, Name: "Cage Two", Status: CageStatusActive, MaxCapacity: 3})
+	asserter.NoError(err)
+	for _, cage := range []Cage{
+		{Name: "small_cage", Status: CageStatusActive, MaxCapacity: 1},
+		{Name: "stego_cage", Status: CageStatusActive, MaxCapacity: 2},
+		{Name: "failing_cage", Status: CageStatusActive, MaxCapacity: 2},
+	} {
+		_, err := dinoService.AddCage(ctx, cage)
+		asserter.NoError(err)
+	}
+	smallCageId := getCageId(t, dinoService, "small_cage")
+	stegoCageId := getCageId(t, dinoService, "stego_cage")
+	failingCageId := getCageId(t, dinoService, "failing_cage")
+	_, err = dinoService.AddDino(ctx, Dinosaur{CageId: stegoCageId, Name: "Spike", Species: "Stegosaurus"})
+	asserter.NoError(err)
+	_, err = dinoService.AddDino(ctx, Dinosaur{CageId: failingCageId, Name: "Bumpy", Species: "Ankylosaurus"})
+	asserter.NoError(err)
+	_, err = dinoService.AddDino(ctx, Dinosaur{CageId: failingCageId, Name: "Cera", Species: "Triceratops"})
+	asserter.NoError(err)
+	bumpy := getDinoId(t, dinoService, failingCageId, "Bumpy")
+	cera := getDinoId(t, dinoService, failingCageId, "Cera")
+
+	// Bumpy fits the small cage first, but then Cera has nowhere to go, so Bumpy has to join Spike
+	plan, err := dinoService.EvacuateCage(ctx, failingCageId, true)
 	asserter.NoError(err)
+	asserter.Equal([]Relocation{
+		{DinoId: bumpy, TargetCageId: stegoCageId},
+		{DinoId: cera, TargetCageId: smallCageId},
+	}, plan.Moves)
+	cage, err := dinoService.GetCageById(ctx, failingCageId)
+	asserter.NoError(err)
+	asserter.Equal(int64(2), cage.Occupancy)
+	asserter.Equal(CageStatusActive, cage.Status)
 
-	dinos, err := dinoService.GetDinosByCage(ctx, testCageId)
+	// the cage was read before Cera moved in, the evacuation is refused and nothing moves
+	var serviceErr *ServiceRequestError
+	_, err = dinoService.EvacuateCage(WithIfMatch(ctx, []string{`"1-1"`}), failingCageId, false)
+	asserter.ErrorAs(err, &serviceErr)
+	asserter.Equal(CodePreconditionFailed, serviceErr.code)
+	cage, err = dinoService.GetCageById(ctx, failingCageId)
 	asserter.NoError(err)
-	asserter.Equal("test_dino", dinos[0].Name)
-	asserter.Equal(testCageId, dinos[0].CageId)
-	asserter.Equal("Brachiosaurus", dinos[0].Species)
+	asserter.Equal(int64(2), cage.Occupancy)
 
-	// clean up
-	_, err = client.GetConnection().ExecContext(ctx, "DELETE from dinosaur where dino_name = 'test_dino'")
+	_, err = dinoService.EvacuateCage(WithIfMatch(ctx, []string{cageETag(cage)}), failingCageId, false)
+	asserter.NoError(err)
+	cage, err = dinoService.GetCageById(ctx, failingCageId)
 	asserter.NoError(err)
+	asserter.Equal(int64(0), cage.Occupancy)
+	asserter.Equal(CageStatusDown, cage.Status)
+	dino, err := dinoService.GetDinoById(ctx, cera)
+	asserter.NoError(err)
+	asserter.Equal(smallCageId, dino.CageId)
+
+	// there is no room left for Maggie and Lisa
+	_, err = dinoService.EvacuateCage(ctx, 1, true)
+	asserter.ErrorAs(err, &serviceErr)
+}
+
+func Test_Placement_Options(t *testing.T) {
+
+	ctx := context.Background()
+
+	asserter := assert.New(t)
+
+	dinoService := NewDinoService(getClient())
+
+	_, err := dinoService.AddCage(ctx, Cage{Name: "big_cage", Status: CageStatusActive, MaxCapacity: 10})
+	asserter.NoError(err)
+	bigCageId := getCageId(t, dinoService, "big_cage")
 
-	_, err = client.GetConnection().ExecContext(ctx, "DELETE from cage where cage_name = 'test_cage'")
+	// Cage One already holds Tyrannosaurus so it comes before the emptier big cage
+	options, err := dinoService.GetPlacementOptions(ctx, "Tyrannosaurus")
 	asserter.NoError(err)
+	asserter.Len(options.Allowed, 2)
+	asserter.Equal(int64(1), options.Allowed[0].Cage.Id)
+	asserter.True(options.Allowed[0].SpeciesMatch)
+	asserter.Equal(bigCageId, options.Allowed[1].Cage.Id)
+	asserter.Len(options.Rejected, 1)
+	asserter.Equal(int64(2), options.Rejected[0].Cage.Id)
+	asserter.Equal("diet_separation", options.Rejected[0].Violations[0].Rule)
+
+	// a full or DOWN cage refuses the dino whoever is inside, only the rule about the cage itself is given
+	_, err = dinoService.AddCage(ctx, Cage{Name: "tiny_cage", Status: CageStatusActive, MaxCapacity: 1})
+	asserter.NoError(err)
+	tinyCageId := getCageId(t, dinoService, "tiny_cage")
+	_, err = dinoService.AddDino(ctx, Dinosaur{CageId: tinyCageId, Name: "Cera", Species: "Triceratops"})
+	asserter.NoError(err)
+	_, err = dinoService.AddCage(ctx, Cage{Name: "dark_cage", Status: CageStatusDown, MaxCapacity: 4})
+	asserter.NoError(err)
+	options, err = dinoService.GetPlacementOptions(ctx, "Tyrannosaurus")
+	asserter.NoError(err)
+	asserter.Len(options.Allowed, 2)
+	asserter.Len(options.Rejected, 3)
+	rules := map[int64][]string{}
+	for _, option := range options.Rejected {
+		for _, violation := range option.Violations {
+			rules[option.Cage.Id] = append(rules[option.Cage.Id], violation.Rule)
+		}
+	}
+	asserter.Equal([]string{"cage_capacity"}, rules[tinyCageId])
+	asserter.Equal([]string{"cage_powered"}, rules[getCageId(t, dinoService, "dark_cage")])
+
+	_, err = dinoService.GetPlacementOptions(ctx, "Dodo")
+	var serviceErr *ServiceRequestError
+	asserter.ErrorAs(err, &serviceErr)
+
+	// Homer the Stegosaurus is not offered the cage it is in
+	homer := getDinoId(t, dinoService, 2, "Homer")
+	options, err = dinoService.GetDinoPlacementOptions(ctx, homer)
+	asserter.NoError(err)
+	asserter.Len(options.Allowed, 1)
+	asserter.Equal(bigCageId, options.Allowed[0].Cage.Id)
+	asserter.Len(options.Rejected, 3)
+	asserter.Equal(int64(1), options.Rejected[0].Cage.Id)
+
+	_, err = dinoService.GetDinoPlacementOptions(ctx, 99)
+	asserter.ErrorIs(err, sql.ErrNoRows)
+}
 
+func Test_Audit_Log(t *testing.T) {
+
+	ctx := WithActor(context.Background(), "muldoon")
+
+	asserter := assert.New(t)
+
+	dinoService := NewDinoService(getClient())
+	start := time.Now()
+
+	_, err := dinoService.AddCage(ctx, Cage{Name: "test_cage", Status: CageStatusActive, MaxCapacity: 2})
+	asserter.NoError(err)
+	testCageId := getCageId(t, dinoService, "test_cage")
+	_, err = dinoService.AddDino(ctx, Dinosaur{CageId: testCageId, Name: "Blue", Species: "Velociraptor"})
+	asserter.NoError(err)
+	blue := getDinoId(t, dinoService, testCageId, "Blue")
+	_, err = dinoService.UpdateDino(ctx, Dinosaur{Id: blue, CageId: testCageId, Name: "Blue II", Species: "Velociraptor"})
+	asserter.NoError(err)
+	// a refused change is not recorded
+	_, err = dinoService.UpdateDino(ctx, Dinosaur{Id: blue, CageId: 1, Name: "Blue II", Species: "Velociraptor"})
+	asserter.Error(err)
+	err = dinoService.DeleteDino(ctx, blue, true)
+	asserter.NoError(err)
+
+	events, err := dinoService.GetAuditEvents(ctx, AuditFilter{Entity: AuditEntityDinosaur, EntityId: blue}, PageRequest{})
+	asserter.NoError(err)
+	asserter.Len(events.Items, 3)
+	actions := []string{}
+	for _, event := range events.Items {
+		asserter.Equal("muldoon", event.Actor)
+		actions = append(actions, event.Action)
+	}
+	asserter.Equal([]string{AuditCreate, AuditUpdate, AuditArchive}, actions)
+	asserter.JSONEq(fmt.Sprintf(`{"id": %d, "cage_id": %d, "dino_name": "Blue", "dino_species": "Velociraptor", "version": 1}`, blue, testCageId), string(events.Items[1].Before))
+	asserter.JSONEq(fmt.Sprintf(`{"id": %d, "cage_id": %d, "dino_name": "Blue II", "dino_species": "Velociraptor", "version": 2}`, blue, testCageId), string(events.Items[1].After))
+	asserter.Nil(events.Items[0].Before)
+	asserter.Nil(events.Items[2].After)
+
+	events, err = dinoService.GetAuditEvents(ctx, AuditFilter{Entity: AuditEntityCage}, PageRequest{})
+	asserter.NoError(err)
+	asserter.Len(events.Items, 1)
+	asserter.Equal(testCageId, events.Items[0].EntityId)
+
+	events, err = dinoService.GetAuditEvents(ctx, AuditFilter{From: start.Add(-time.Hour), To: start}, PageRequest{})
+	asserter.NoError(err)
+	asserter.Empty(events.Items)
+
+	_, err = dinoService.GetAuditEvents(ctx, AuditFilter{From: start, To: start.Add(-time.Hour)}, PageRequest{})
+	var serviceErr *ServiceRequestError
+	asserter.ErrorAs(err, &serviceErr)
+}
+
+func Test_Dino_History_and_Cage_Occupancy(t *testing.T) {
+
+	ctx := context.Background()
+
+	asserter := assert.New(t)
+
+	dinoService := NewDinoService(getClient())
+
+	_, err := dinoService.AddCage(ctx, Cage{Name: "test_cage", Status: CageStatusActive, MaxCapacity: 2})
+	asserter.NoError(err)
+	testCageId := getCageId(t, dinoService, "test_cage")
+	_, err = dinoService.AddDino(ctx, Dinosaur{CageId: 2, Name: "Cera", Species: "Triceratops"})
+	asserter.NoError(err)
+	cera := getDinoId(t, dinoService, 2, "Cera")
+	inCageTwo := time.Now()
+
+	// renaming is not a move
+	_, err = dinoService.UpdateDino(ctx, Dinosaur{Id: cera, CageId: 2, Name: "Cera II", Species: "Triceratops"})
+	asserter.NoError(err)
+	_, err = dinoService.UpdateDino(ctx, Dinosaur{Id: cera, CageId: testCageId, Name: "Cera II", Species: "Triceratops"})
+	asserter.NoError(err)
+
+	history, err := dinoService.GetDinoHistory(ctx, cera, PageRequest{})
+	asserter.NoError(err)
+	asserter.Len(history.Items, 2)
+	asserter.Equal(int64(2), history.Items[0].CageId)
+	asserter.Equal(testCageId, history.Items[1].CageId)
+	asserter.Equal("Cera II", history.Items[1].DinoName)
+	asserter.Equal(history.Items[1].From, *history.Items[0].To)
+	asserter.Nil(history.Items[1].To)
+
+	occupancy, err := dinoService.GetCageOccupancy(ctx, 2, inCageTwo)
+	asserter.NoError(err)
+	asserter.Len(occupancy.Placements, 4)
+	occupancy, err = dinoService.GetCageOccupancy(ctx, testCageId, inCageTwo)
+	asserter.NoError(err)
+	asserter.Empty(occupancy.Placements)
+	occupancy, err = dinoService.GetCageOccupancy(ctx, testCageId, time.Now())
+	asserter.NoError(err)
+	asserter.Len(occupancy.Placements, 1)
+
+	// an archived dino keeps its history, which ends when it was archived
+	err = dinoService.DeleteDino(ctx, cera, true)
+	asserter.NoError(err)
+	history, err = dinoService.GetDinoHistory(ctx, cera, PageRequest{})
+	asserter.NoError(err)
+	asserter.NotNil(history.Items[1].To)
+	occupancy, err = dinoService.GetCageOccupancy(ctx, testCageId, time.Now())
+	asserter.NoError(err)
+	asserter.Empty(occupancy.Placements)
+
+	_, err = dinoService.GetDinoHistory(ctx, 99, PageRequest{})
+	asserter.ErrorIs(err, sql.ErrNoRows)
+	_, err = dinoService.GetCageOccupancy(ctx, 99, time.Now())
+	asserter.ErrorIs(err, sql.ErrNoRows)
+}
+
+func writePolicy(t *testing.T, path string, policy string) {
+	err := os.WriteFile(path, []byte(policy), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
 }
 
-func getClient() (db.DbService, error) {
-	return db.NewDbService("localhost", "postgres", "postgres", "postgres", "5432")
+func Test_Patch_Dino_and_Cage(t *testing.T) {
+
+	ctx := context.Background()
+
+	asserter := assert.New(t)
+
+	// a rule refusing every move shows the rules only run when a patch changes the cage
+	rules := append(DefaultContainmentRules(), noMovesRule{})
+	dinoService := NewDinoServiceWithRules(getClient(), rules)
+
+	dino, err := dinoService.PatchDino(ctx, 1, json.RawMessage(`{"dino_name": "Maggie II"}`))
+	asserter.NoError(err)
+	asserter.Equal(Dinosaur{Id: 1, CageId: 1, Name: "Maggie II", Species: "Tyrannosaurus", Version: 2}, dino)
+
+	_, err = dinoService.PatchDino(ctx, 1, json.RawMessage(`{"cage_id": 2}`))
+	var serviceErr *ServiceRequestError
+	asserter.ErrorAs(err, &serviceErr)
+	asserter.Equal("no_moves", serviceErr.violations[len(serviceErr.violations)-1].Rule)
+
+	// the species may be given, but only as it is
+	dino, err = dinoService.PatchDino(ctx, 1, json.RawMessage(`{"dino_name": "Maggie", "dino_species": "Tyrannosaurus"}`))
+	asserter.NoError(err)
+	asserter.Equal("Maggie", dino.Name)
+
+	refused := map[string]FieldError{
+		`{"dino_name": null}`:              {Field: "dino_name", Rule: "required"},
+		`{"dino_species": "Velociraptor"}`: {Field: "dino_species", Rule: "readonly"},
+		`{"id": 7}`:                        {Field: "id", Rule: "readonly"},
+		`{"colour": "green"}`:              {Field: "colour", Rule: "unknown"},
+		`{"cage_id": "two"}`:               {Field: "cage_id", Rule: "type", Param: "int64"},
+	}
+	for patch, field := range refused {
+		_, err = dinoService.PatchDino(ctx, 1, json.RawMessage(patch))
+		serviceErr = nil
+		asserter.ErrorAs(err, &serviceErr, patch)
+		asserter.Equal(CodeValidationFailed, serviceErr.code, patch)
+		asserter.Equal([]FieldError{field}, serviceErr.fields, patch)
+	}
+
+	_, err = dinoService.PatchDino(ctx, 1, json.RawMessage(`["dino_name"]`))
+	asserter.ErrorAs(err, &serviceErr)
+	asserter.Equal(CodeBadRequest, serviceErr.code)
+	_, err = dinoService.PatchDino(ctx, 99, json.RawMessage(`{}`))
+	asserter.ErrorIs(err, sql.ErrNoRows)
+
+	cage, err := dinoService.PatchCage(ctx, 2, json.RawMessage(`{"max_capacity": 8}`))
+	asserter.NoError(err)
+	asserter.Equal(Cage{Id: 2, Name: "Cage Two", Status: CageStatusActive, MaxCapacity: 8, Occupancy: 3, RemainingSlots: 5, Version: 2}, cage)
+
+	// a patched cage is held to the same checks as a replaced one
+	_, err = dinoService.PatchCage(ctx, 2, json.RawMessage(`{"cage_status": "DOWN"}`))
+	asserter.ErrorAs(err, &serviceErr)
+	asserter.Equal(CodeCageNotEmpty, serviceErr.code)
+	_, err = dinoService.PatchCage(ctx, 2, json.RawMessage(`{"max_capacity": 0}`))
+	asserter.ErrorAs(err, &serviceErr)
+	asserter.Equal([]FieldError{{Field: "max_capacity", Rule: "required"}}, serviceErr.fields)
+}
+
+func Test_Idempotent_Requests(t *testing.T) {
+
+	ctx := WithActor(context.Background(), "muldoon")
+
+	asserter := assert.New(t)
+
+	dinoService := NewDinoService(getClient())
+
+	stored, err := dinoService.BeginIdempotentRequest(ctx, "intake-1", "fingerprint")
+	asserter.NoError(err)
+	asserter.Nil(stored)
+
+	// a retry while the first request is still being handled has nothing to replay yet
+	_, err = dinoService.BeginIdempotentRequest(ctx, "intake-1", "fingerprint")
+	var serviceErr *ServiceRequestError
+	asserter.ErrorAs(err, &serviceErr)
+	asserter.Equal(CodeIdempotencyKeyInUse, serviceErr.code)
+
+	asserter.NoError(dinoService.CompleteIdempotentRequest(ctx, "intake-1", http.StatusCreated, map[string]string{"Location": "/v1/dinosaur/6"}, []byte(`{"id": 6}`)))
+	stored, err = dinoService.BeginIdempotentRequest(ctx, "intake-1", "fingerprint")
+	asserter.NoError(err)
+	asserter.Equal(http.StatusCreated, stored.Status)
+	asserter.Equal("/v1/dinosaur/6", stored.Header["Location"])
+	asserter.Equal(`{"id": 6}`, string(stored.Body))
+
+	_, err = dinoService.BeginIdempotentRequest(ctx, "intake-1", "another fingerprint")
+	asserter.ErrorAs(err, &serviceErr)
+	asserter.Equal(CodeIdempotencyKeyReused, serviceErr.code)
+
+	// keys belong to the caller that sent them
+	stored, err = dinoService.BeginIdempotentRequest(WithActor(ctx, "nedry"), "intake-1", "another fingerprint")
+	asserter.NoError(err)
+	asserter.Nil(stored)
+
+	// a released key is free again
+	stored, err = dinoService.BeginIdempotentRequest(ctx, "intake-2", "fingerprint")
+	asserter.NoError(err)
+	asserter.Nil(stored)
+	asserter.NoError(dinoService.ReleaseIdempotentRequest(ctx, "intake-2"))
+	stored, err = dinoService.BeginIdempotentRequest(ctx, "intake-2", "another fingerprint")
+	asserter.NoError(err)
+	asserter.Nil(stored)
+
+	// once its response expired a key can be used for another request
+	expiring := dinoService.WithIdempotencyTTL(-time.Second)
+	stored, err = expiring.BeginIdempotentRequest(ctx, "intake-3", "fingerprint")
+	asserter.NoError(err)
+	asserter.Nil(stored)
+	asserter.NoError(expiring.CompleteIdempotentRequest(ctx, "intake-3", http.StatusNoContent, nil, nil))
+	stored, err = expiring.BeginIdempotentRequest(ctx, "intake-3", "another fingerprint")
+	asserter.NoError(err)
+	asserter.Nil(stored)
+
+	// a request never answered holds its key for the lease only, then it is purged and a retry is handled again
+	lapsed := dinoService.WithIdempotencyLease(-time.Second)
+	stored, err = lapsed.BeginIdempotentRequest(ctx, "intake-4", "fingerprint")
+	asserter.NoError(err)
+	asserter.Nil(stored)
+	purged, err := dinoService.PurgeIdempotentRequests(ctx)
+	asserter.NoError(err)
+	asserter.Equal(int64(1), purged)
+	stored, err = dinoService.BeginIdempotentRequest(ctx, "intake-4", "fingerprint")
+	asserter.NoError(err)
+	asserter.Nil(stored)
+
+	// the lease does not shorten how long a response is kept
+	stored, err = lapsed.BeginIdempotentRequest(ctx, "intake-5", "fingerprint")
+	asserter.NoError(err)
+	asserter.Nil(stored)
+	asserter.NoError(lapsed.CompleteIdempotentRequest(ctx, "intake-5", http.StatusNoContent, nil, nil))
+	stored, err = lapsed.BeginIdempotentRequest(ctx, "intake-5", "fingerprint")
+	asserter.NoError(err)
+	asserter.Equal(http.StatusNoContent, stored.Status)
+
+	_, err = dinoService.BeginIdempotentRequest(ctx, "", "fingerprint")
+	asserter.ErrorAs(err, &serviceErr)
+	asserter.Equal(CodeBadRequest, serviceErr.code)
+}
+
+func Test_Park_Events(t *testing.T) {
+
+	ctx := context.Background()
+
+	asserter := assert.New(t)
+
+	dinoService := NewDinoService(getClient())
+
+	// the seed data is not in the event log
+	lastId, err := dinoService.LastEventId(ctx)
+	asserter.NoError(err)
+	asserter.Zero(lastId)
+
+	committed := dinoService.EventsCommitted()
+	cage, err := dinoService.AddCage(ctx, Cage{Name: "Cage Three", Status: CageStatusActive, MaxCapacity: 4})
+	asserter.NoError(err)
+	select {
+	case <-committed:
+	default:
+		asserter.Fail("the event streams were not woken")
+	}
+
+	cera, err := dinoService.AddDino(ctx, Dinosaur{Name: "Cera", Species: "Triceratops", CageId: cage.Id})
+	asserter.NoError(err)
+	_, err = dinoService.UpdateDino(ctx, Dinosaur{Id: 3, CageId: cage.Id, Name: "Bart", Species: "Brachiosaurus"})
+	asserter.NoError(err)
+	// a dino staying in its cage has not moved
+	_, err = dinoService.UpdateDino(ctx, Dinosaur{Id: 3, CageId: cage.Id, Name: "Bartholomew", Species: "Brachiosaurus"})
+	asserter.NoError(err)
+	asserter.NoError(dinoService.DeleteDino(ctx, cera.Id, true))
+	_, err = dinoService.EvacuateCage(ctx, cage.Id, false)
+	asserter.NoError(err)
+
+	events, err := dinoService.GetEvents(ctx, 0)
+	asserter.NoError(err)
+	types := []string{}
+	for _, event := range events {
+		types = append(types, event.Type)
+	}
+	asserter.Equal([]string{
+		EventCageCreated,
+		EventDinosaurAdded,
+		EventDinosaurMoved,
+		EventDinosaurRemoved,
+		EventDinosaurMoved,
+		EventCageStatusChanged,
+	}, types)
+
+	moved := DinosaurMoved{}
+	asserter.NoError(json.Unmarshal(events[2].Data, &moved))
+	asserter.Equal(int64(2), moved.FromCageId)
+	asserter.Equal(cage.Id, moved.ToCageId)
+	asserter.Equal("Bart", moved.Dinosaur.Name)
+	changed := CageStatusChanged{}
+	asserter.NoError(json.Unmarshal(events[5].Data, &changed))
+	asserter.Equal(CageStatusChanged{Cage: changed.Cage, From: CageStatusActive, To: CageStatusDown}, changed)
+	asserter.Equal(cage.Id, changed.Cage.Id)
+
+	// a stream resumes after the last event it saw
+	events, err = dinoService.GetEvents(ctx, 4)
+	asserter.NoError(err)
+	asserter.Len(events, 2)
+	asserter.Equal(int64(5), events[0].Id)
+	lastId, err = dinoService.LastEventId(ctx)
+	asserter.NoError(err)
+	asserter.Equal(int64(6), lastId)
+
+	_, err = dinoService.GetEvents(ctx, -1)
+	var serviceErr *ServiceRequestError
+	asserter.ErrorAs(err, &serviceErr)
+	asserter.Equal(CodeValidationFailed, serviceErr.code)
+}
+
+type noMovesRule struct{}
+
+func (noMovesRule) Name() string { return "no_moves" }
+
+func (noMovesRule) Check(p Placement) *RuleViolation {
+	if p.From != 0 && p.From != p.Cage.Id {
+		return &RuleViolation{Reason: "No dinosaur may be moved"}
+	}
+	return nil
+}
+
+type noStegosaurusRule struct{}
+
+func (noStegosaurusRule) Name() string { return "no_stegosaurus" }
+
+func (noStegosaurusRule) Check(p Placement) *RuleViolation {
+	if p.Dino.Species == "Stegosaurus" && p.From == 0 {
+		return &RuleViolation{Reason: "No new Stegosaurus are accepted"}
+	}
+	return nil
+}
+
+func getClient() db.DbService {
+	return db.NewMemoryService()
+}
+
+func getDinoId(t *testing.T, dinoService DinoService, cageId int64, name string) int64 {
+	dinos, err := dinoService.GetDinosByCage(context.Background(), cageId, PageRequest{})
+	assert.NoError(t, err)
+	for _, dino := range dinos.Items {
+		if dino.Name == name {
+			return dino.Id
+		}
+	}
+	t.Fatalf("dino %s not found", name)
+	return 0
+}
+
+func getCageId(t *testing.T, dinoService DinoService, name string) int64 {
+	cages, err := dinoService.GetCages(context.Background(), CageFilter{}, PageRequest{})
+	assert.NoError(t, err)
+	for _, cage := range cages.Items {
+		if cage.Name == name {
+			return cage.Id
+		}
+	}
+	t.Fatalf("cage %s not found", name)
+	return 0
 }
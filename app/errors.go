@@ -1,45 +1,241 @@
 package app
 
 import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"jp/app/db"
 	"net/http"
+	"reflect"
+	"strings"
 
 	"github.com/go-chi/render"
+	validate "github.com/go-playground/validator/v10"
 )
 
+// ErrorCode is the stable, machine readable reason a request failed, clients match on it rather than the detail
+type ErrorCode string
+
+const (
+	CodeBadRequest   ErrorCode = "BAD_REQUEST"
+	CodeUnauthorized ErrorCode = "UNAUTHORIZED"
+	CodeForbidden    ErrorCode = "FORBIDDEN"
+	CodeNotFound     ErrorCode = "NOT_FOUND"
+	// CodeUnsupportedMediaType is a request body of a type the endpoint does not take
+	CodeUnsupportedMediaType ErrorCode = "UNSUPPORTED_MEDIA_TYPE"
+	CodeServerError          ErrorCode = "INTERNAL_ERROR"
+	// CodeConflict is a write clashing with a record that already exists
+	CodeConflict ErrorCode = "CONFLICT"
+	// CodeInvalidReference is a write pointing at a record that does not exist
+	CodeInvalidReference ErrorCode = "INVALID_REFERENCE"
+	// CodeValidationFailed comes with the fields that failed in errors
+	CodeValidationFailed ErrorCode = "VALIDATION_FAILED"
+	CodeCageNotFound     ErrorCode = "CAGE_NOT_FOUND"
+	CodeCageNotEmpty     ErrorCode = "CAGE_NOT_EMPTY"
+	CodeUnknownSpecies   ErrorCode = "UNKNOWN_SPECIES"
+	CodeSpeciesInUse     ErrorCode = "SPECIES_IN_USE"
+	// the placement codes come with the broken rules in violations
+	CodeCagePoweredDown  ErrorCode = "CAGE_POWERED_DOWN"
+	CodeCapacityExceeded ErrorCode = "CAPACITY_EXCEEDED"
+	CodeSpeciesConflict  ErrorCode = "SPECIES_CONFLICT"
+	// CodePlacementRefused is for a rule without a code of its own
+	CodePlacementRefused ErrorCode = "PLACEMENT_REFUSED"
+	// CodeRelocationRefused comes with the refused moves in relocations
+	CodeRelocationRefused ErrorCode = "RELOCATION_REFUSED"
+	CodeNoEvacuationPlan  ErrorCode = "NO_EVACUATION_PLAN"
+	// CodePreconditionFailed is an If-Match that no longer matches the record, CodePreconditionRequired
+	// an update or delete sent without one
+	CodePreconditionFailed   ErrorCode = "PRECONDITION_FAILED"
+	CodePreconditionRequired ErrorCode = "PRECONDITION_REQUIRED"
+	// CodeIdempotencyKeyReused is an Idempotency-Key sent again with a different request, CodeIdempotencyKeyInUse
+	// one sent again while the first request is still being handled
+	CodeIdempotencyKeyReused ErrorCode = "IDEMPOTENCY_KEY_REUSED"
+	CodeIdempotencyKeyInUse  ErrorCode = "IDEMPOTENCY_KEY_IN_USE"
+)
+
+// codeStatus holds the codes that are not sent as a 400. A request clashing with the records as they stand
+// is a 409, one naming a record that does not exist is a 422 and one made against a stale read is a 412.
+var codeStatus = map[ErrorCode]int{
+	CodeConflict:             http.StatusConflict,
+	CodeCageNotEmpty:         http.StatusConflict,
+	CodeSpeciesInUse:         http.StatusConflict,
+	CodeIdempotencyKeyReused: http.StatusConflict,
+	CodeIdempotencyKeyInUse:  http.StatusConflict,
+	CodeInvalidReference:     http.StatusUnprocessableEntity,
+	CodeCageNotFound:         http.StatusUnprocessableEntity,
+	CodeUnknownSpecies:       http.StatusUnprocessableEntity,
+	CodePreconditionFailed:   http.StatusPreconditionFailed,
+}
+
+// problemContentType is the media type of RFC 7807 problem details
+const problemContentType = "application/problem+json"
+
+// ErrorResponse is an RFC 7807 problem. Code, Errors, Violations and Relocations are extension members.
 type ErrorResponse struct {
-	Err        error  `json:"-"`
-	StatusCode int    `json:"-"`
-	StatusText string `json:"status_text"`
-	Message    string `json:"message"`
+	Err         error               `json:"-"`
+	Type        string              `json:"type"`
+	Title       string              `json:"title"`
+	Status      int                 `json:"status"`
+	Detail      string              `json:"detail,omitempty"`
+	Instance    string              `json:"instance,omitempty"`
+	Code        ErrorCode           `json:"code"`
+	Errors      []FieldError        `json:"errors,omitempty"`
+	Violations  []RuleViolation     `json:"violations,omitempty"`
+	Relocations []RelocationFailure `json:"relocations,omitempty"`
+}
+
+// FieldError is one field of a request that failed validation, Rule is the validation it failed
+type FieldError struct {
+	Field string `json:"field"`
+	Rule  string `json:"rule"`
+	Param string `json:"param,omitempty"`
 }
 
 func (e *ErrorResponse) Render(w http.ResponseWriter, r *http.Request) error {
-	render.Status(r, e.StatusCode)
+	e.Instance = r.URL.Path
+	render.Status(r, e.Status)
 	return nil
 }
 
-func BadRequest(err error) *ErrorResponse {
-	return &ErrorResponse{
-		Err:        err,
-		StatusCode: 400,
-		StatusText: "Bad request",
-		Message:    err.Error(),
+func init() {
+	render.Respond = respond
+}
+
+// respond sends problems as application/problem+json, everything else is left to the default responder
+func respond(w http.ResponseWriter, r *http.Request, v interface{}) {
+	problem, ok := v.(*ErrorResponse)
+	if !ok {
+		render.DefaultResponder(w, r, v)
+		return
 	}
+	body, err := json.Marshal(problem)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", problemContentType)
+	w.WriteHeader(problem.Status)
+	w.Write(body) //nolint:errcheck
 }
 
-func ServerError(err error) *ErrorResponse {
+func newProblem(err error, status int, code ErrorCode) *ErrorResponse {
 	return &ErrorResponse{
-		Err:        err,
-		StatusCode: 500,
-		StatusText: "Internal server error",
-		Message:    err.Error(),
+		Err:    err,
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: err.Error(),
+		Code:   code,
 	}
 }
 
+func BadRequest(err error) *ErrorResponse {
+	return newProblem(err, http.StatusBadRequest, CodeBadRequest)
+}
+
+func ServerError(err error) *ErrorResponse {
+	return newProblem(err, http.StatusInternalServerError, CodeServerError)
+}
+
+func Unauthorized(err error) *ErrorResponse {
+	return newProblem(err, http.StatusUnauthorized, CodeUnauthorized)
+}
+
+func Forbidden(err error) *ErrorResponse {
+	return newProblem(err, http.StatusForbidden, CodeForbidden)
+}
+
 func NotFound(err error) *ErrorResponse {
-	return &ErrorResponse{
-		Err:        err,
-		StatusCode: 404,
-		StatusText: "Not found",
+	return newProblem(err, http.StatusNotFound, CodeNotFound)
+}
+
+func UnsupportedMediaType(err error) *ErrorResponse {
+	return newProblem(err, http.StatusUnsupportedMediaType, CodeUnsupportedMediaType)
+}
+
+func PreconditionRequired(err error) *ErrorResponse {
+	return newProblem(err, http.StatusPreconditionRequired, CodePreconditionRequired)
+}
+
+func Conflict(err error) *ErrorResponse {
+	return newProblem(err, http.StatusConflict, CodeConflict)
+}
+
+func UnprocessableEntity(err error) *ErrorResponse {
+	return newProblem(err, http.StatusUnprocessableEntity, CodeInvalidReference)
+}
+
+// RequestFailed renders a ServiceRequestError with its code, listing any fields that failed
+// validation, containment rules it broke and refused relocations
+func RequestFailed(err *ServiceRequestError) *ErrorResponse {
+	resp := BadRequest(errors.New(err.response))
+	if err.code != "" {
+		resp.Code = err.code
+	}
+	if status, ok := codeStatus[resp.Code]; ok {
+		resp.Status = status
+		resp.Title = http.StatusText(status)
+	}
+	resp.Errors = err.fields
+	resp.Violations = err.violations
+	resp.Relocations = err.relocations
+	return resp
+}
+
+// errorResponse is the response to an error returned by the DinoService, every handler maps errors with it
+// so the same failure gets the same status everywhere
+func errorResponse(err error) *ErrorResponse {
+	var serviceErr *ServiceRequestError
+	switch {
+	case errors.As(err, &serviceErr):
+		return RequestFailed(serviceErr)
+	case errors.Is(err, sql.ErrNoRows):
+		return NotFound(errors.New("not found"))
+	case errors.Is(err, db.ErrDuplicate):
+		return Conflict(errors.New("this conflicts with a record that already exists"))
+	case errors.Is(err, db.ErrReferenced):
+		return Conflict(errors.New("this record is still referenced by other records"))
+	case errors.Is(err, db.ErrMissingReference):
+		return UnprocessableEntity(errors.New("this refers to a record that does not exist"))
+	}
+	return ServerError(errors.New("server error"))
+}
+
+// newValidator reports fields by their json names, falling back to the Go name for fields without one
+func newValidator() *validate.Validate {
+	v := validate.New()
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+	return v
+}
+
+// validationFailed turns the errors of a validator into a VALIDATION_FAILED ServiceRequestError
+func validationFailed(err error) *ServiceRequestError {
+	var errString strings.Builder
+	fields := []FieldError{}
+	var vErrors validate.ValidationErrors
+	if errors.As(err, &vErrors) {
+		for _, validationError := range vErrors {
+			errString.WriteString(fmt.Sprintf("Invalid entry for %s. ", validationError.StructField()))
+			// the namespace starts with the name of the struct, which the client never sees
+			_, field, _ := strings.Cut(validationError.Namespace(), ".")
+			fields = append(fields, FieldError{
+				Field: field,
+				Rule:  validationError.Tag(),
+				Param: validationError.Param(),
+			})
+		}
+	}
+	return &ServiceRequestError{
+		err:      err.Error(),
+		response: errString.String(),
+		code:     CodeValidationFailed,
+		fields:   fields,
 	}
 }
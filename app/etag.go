@@ -0,0 +1,108 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/render"
+	"github.com/rs/zerolog"
+)
+
+// dinoETag is the strong entity tag of a dino, its version
+func dinoETag(dino Dinosaur) string {
+	return fmt.Sprintf(`"%d"`, dino.Version)
+}
+
+// cageETag is the strong entity tag of a cage. Its occupancy is counted on read rather than stored
+// so it is part of the tag as well as the version, a cage changes when dinos move in or out.
+// Moves leave the version alone: bumping it would mean locking the cage a dino leaves as well as
+// the one it joins, and two moves in opposite directions would then wait on each other. So an
+// If-Match on a cage fails after any move in or out of it, and the client reads the cage again.
+func cageETag(cage Cage) string {
+	return fmt.Sprintf(`"%d-%d"`, cage.Version, cage.Occupancy)
+}
+
+type ifMatchKey struct{}
+
+// WithIfMatch makes the updates and deletes done with ctx conditional on the record still having one of the
+// entity tags, "*" matches any record. No tags lifts the condition.
+func WithIfMatch(ctx context.Context, etags []string) context.Context {
+	return context.WithValue(ctx, ifMatchKey{}, etags)
+}
+
+// checkIfMatch fails with PRECONDITION_FAILED when ctx carries an If-Match condition etag does not meet,
+// it is called once the record is locked so the record cannot change between the check and the write
+func checkIfMatch(ctx context.Context, etag string) error {
+	etags, _ := ctx.Value(ifMatchKey{}).([]string)
+	if len(etags) == 0 || matchETag(etags, etag, false) {
+		return nil
+	}
+	return &ServiceRequestError{
+		err:      fmt.Sprintf("etag %s does not match %s", etag, strings.Join(etags, ", ")),
+		response: "The record has changed since it was read, fetch it again before changing it",
+		code:     CodePreconditionFailed,
+	}
+}
+
+// parseETags splits an If-Match or If-None-Match header into its entity tags
+func parseETags(header string) []string {
+	etags := []string{}
+	for _, etag := range strings.Split(header, ",") {
+		etag = strings.TrimSpace(etag)
+		if etag != "" {
+			etags = append(etags, etag)
+		}
+	}
+	return etags
+}
+
+// matchETag reports whether etag is one of etags. If-Match compares strongly, a weak tag never matches,
+// If-None-Match compares weakly and ignores the W/ prefix (RFC 9110 section 8.8.3.2).
+func matchETag(etags []string, etag string, weak bool) bool {
+	for _, candidate := range etags {
+		if candidate == "*" {
+			return true
+		}
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+			etag = strings.TrimPrefix(etag, "W/")
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// requireIfMatch refuses updates and deletes sent without an If-Match header with a 428, so a client cannot
+// overwrite a change it has not seen. The header is handed to the DinoService, which checks it.
+func requireIfMatch(logger *zerolog.Logger) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			etags := parseETags(r.Header.Get("If-Match"))
+			if len(etags) == 0 {
+				logger.Error().Str("path", r.URL.Path).Msg("missing If-Match")
+				err := render.Render(w, r, PreconditionRequired(errors.New("an If-Match header with the ETag of the record is required")))
+				if err != nil {
+					logger.Error().Err(err).Msg("render error")
+				}
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(WithIfMatch(r.Context(), etags)))
+		})
+	}
+}
+
+// notModified sets the ETag of the record being read and reports whether If-None-Match already holds it,
+// in which case a 304 has been sent instead of the record
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	if !matchETag(parseETags(r.Header.Get("If-None-Match")), etag, true) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
@@ -0,0 +1,191 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"jp/app/db"
+	"sort"
+)
+
+// maxEvacuationChecks bounds the evacuation search, a cage that cannot be planned within it is refused
+const maxEvacuationChecks = 100000
+
+// EvacuateCage works out where every dino in a cage can go among the other ACTIVE cages and returns the plan.
+// Unless dryRun is set the plan is carried out and the cage is marked DOWN, all in one transaction.
+// If any dino has nowhere to go nothing is moved.
+func (s dinoServiceImpl) EvacuateCage(ctx context.Context, cageId int64, dryRun bool) (RelocationPlan, error) {
+	catalogue, err := s.species.load(ctx, s.dbService.Species())
+	if err != nil {
+		return RelocationPlan{}, err
+	}
+
+	plan := RelocationPlan{}
+	err = s.inTx(ctx, func(repos db.Repositories) error {
+		// nothing can be put in the cage while it is being emptied
+		cage, err := repos.Cages().GetForUpdate(ctx, cageId)
+		if err != nil {
+			return err
+		}
+		err = checkIfMatch(ctx, cageETag(cage))
+		if err != nil {
+			return err
+		}
+		dinos, err := repos.Dinos().ListByCage(ctx, cageId)
+		if err != nil {
+			return err
+		}
+
+		planner := evacuationPlanner{
+			rules:     s.rules,
+			catalogue: catalogue,
+			// the plan is made and carried out against one policy even if it is reloaded meanwhile
+			policy:    s.policy.Current(),
+			from:      cageId,
+			occupants: map[int64][]Dinosaur{},
+		}
+		cages, err := repos.Cages().List(ctx, CageFilter{Status: CageStatusActive})
+		if err != nil {
+			return err
+		}
+		for _, target := range cages {
+			if target.Id == cageId || target.Status != CageStatusActive {
+				continue
+			}
+			planner.occupants[target.Id], err = repos.Dinos().ListByCage(ctx, target.Id)
+			if err != nil {
+				return err
+			}
+			planner.cages = append(planner.cages, target)
+		}
+
+		plan.Moves, err = planner.plan(dinos)
+		if err != nil || dryRun {
+			return err
+		}
+
+		// each move is checked again under the target cage lock, in the order it was planned
+		for _, move := range plan.Moves {
+			err = s.relocateDino(ctx, repos, move, catalogue, planner.policy)
+			if err != nil {
+				return err
+			}
+		}
+		down := cage
+		down.Status = CageStatusDown
+		err = repos.Cages().Update(ctx, down)
+		if err != nil {
+			return err
+		}
+		down, err = repos.Cages().Get(ctx, cageId)
+		if err != nil {
+			return err
+		}
+		if down.Status != cage.Status {
+			err = publish(ctx, repos, EventCageStatusChanged, CageStatusChanged{Cage: down, From: cage.Status, To: down.Status})
+			if err != nil {
+				return err
+			}
+		}
+		return audit(ctx, repos, AuditUpdate, AuditEntityCage, cageId, cage, down)
+	})
+	if err != nil {
+		return RelocationPlan{}, err
+	}
+	return plan, nil
+}
+
+// evacuationPlanner searches for a cage for every dino of an evacuated cage, backtracking when
+// an earlier choice leaves a later dino with nowhere to go
+type evacuationPlanner struct {
+	rules     ContainmentRules
+	catalogue map[string]Species
+	policy    *Policy
+	from      int64
+	cages     []Cage
+	occupants map[int64][]Dinosaur
+	checks    int
+}
+
+func (p *evacuationPlanner) plan(dinos []Dinosaur) ([]Relocation, error) {
+	// carnivores have the fewest places to go, placing them first keeps the search short,
+	// grouping a species together lets them share the same cages
+	ordered := make([]Dinosaur, len(dinos))
+	copy(ordered, dinos)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		iCarnivore := p.catalogue[ordered[i].Species].Diet == DietCarnivore
+		jCarnivore := p.catalogue[ordered[j].Species].Diet == DietCarnivore
+		if iCarnivore != jCarnivore {
+			return iCarnivore
+		}
+		return ordered[i].Species < ordered[j].Species
+	})
+
+	moves, ok := p.place(ordered, make([]Relocation, 0, len(ordered)))
+	if ok {
+		return moves, nil
+	}
+
+	// name a dino no cage can take even on its own, when there is one
+	for _, dino := range ordered {
+		if len(p.cagesFor(dino)) == 0 {
+			return nil, &ServiceRequestError{
+				err:      fmt.Sprintf("no cage available for dino %d", dino.Id),
+				response: fmt.Sprintf("There is no ACTIVE cage that can take %s the %s", dino.Name, dino.Species),
+				code:     CodeNoEvacuationPlan,
+			}
+		}
+	}
+	return nil, &ServiceRequestError{
+		err:      fmt.Sprintf("no evacuation plan found for cage %d", p.from),
+		response: "The dinosaurs in this cage cannot all be fitted into the other ACTIVE cages",
+		code:     CodeNoEvacuationPlan,
+	}
+}
+
+// place finds a cage for the first dino and recurses on the rest, undoing the choice if the rest cannot be placed
+func (p *evacuationPlanner) place(dinos []Dinosaur, moves []Relocation) ([]Relocation, bool) {
+	if len(dinos) == 0 {
+		return moves, true
+	}
+	dino := dinos[0]
+	for _, cage := range p.cages {
+		if p.checks >= maxEvacuationChecks {
+			return nil, false
+		}
+		p.checks++
+		current := p.occupants[cage.Id]
+		if !p.allowed(dino, cage, current) {
+			continue
+		}
+		// copied so an undone choice never shares the backing array with the next one
+		p.occupants[cage.Id] = append(current[:len(current):len(current)], dino)
+		plan, ok := p.place(dinos[1:], append(moves, Relocation{DinoId: dino.Id, TargetCageId: cage.Id}))
+		if ok {
+			return plan, true
+		}
+		p.occupants[cage.Id] = current
+	}
+	return nil, false
+}
+
+// cagesFor lists the cages that would take the dino as they stand now
+func (p *evacuationPlanner) cagesFor(dino Dinosaur) []Cage {
+	cages := []Cage{}
+	for _, cage := range p.cages {
+		if p.allowed(dino, cage, p.occupants[cage.Id]) {
+			cages = append(cages, cage)
+		}
+	}
+	return cages
+}
+
+func (p *evacuationPlanner) allowed(dino Dinosaur, cage Cage, occupants []Dinosaur) bool {
+	return len(p.rules.Check(Placement{
+		Dino:      dino,
+		From:      p.from,
+		Cage:      cage,
+		Occupants: occupants,
+		Species:   p.catalogue,
+		Policy:    p.policy,
+	})) == 0
+}
@@ -0,0 +1,273 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"jp/app/db"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/render"
+	"github.com/rs/zerolog"
+)
+
+type ParkEvent = db.ParkEvent
+
+// The events published on the stream, each is recorded in the transaction of the change it describes
+const (
+	// EventDinosaurAdded carries the dino as stored
+	EventDinosaurAdded = "DinosaurAdded"
+	// EventDinosaurMoved carries a DinosaurMoved
+	EventDinosaurMoved = "DinosaurMoved"
+	// EventDinosaurRemoved carries the dino as it was, Archived says whether it was kept on record
+	EventDinosaurRemoved = "DinosaurRemoved"
+	// EventCageCreated carries the cage as stored
+	EventCageCreated = "CageCreated"
+	// EventCageStatusChanged carries a CageStatusChanged
+	EventCageStatusChanged = "CageStatusChanged"
+	// EventCageRemoved carries the cage as it was
+	EventCageRemoved = "CageRemoved"
+)
+
+const (
+	// eventBatchSize is how many events are read from the log at a time
+	eventBatchSize = 100
+	// eventKeepAlive is how often an idle stream is sent a comment, which also has the log read again
+	// in case it was written by another instance of the app
+	eventKeepAlive = 15 * time.Second
+)
+
+// EventSource reads the park events from the log and says when more are committed
+type EventSource interface {
+	GetEvents(ctx context.Context, afterId int64) ([]ParkEvent, error)
+	LastEventId(ctx context.Context) (int64, error)
+	EventsCommitted() <-chan struct{}
+}
+
+// DinosaurMoved is the data of a DinosaurMoved event
+type DinosaurMoved struct {
+	Dinosaur   Dinosaur `json:"dinosaur"`
+	FromCageId int64    `json:"from_cage_id"`
+	ToCageId   int64    `json:"to_cage_id"`
+}
+
+// DinosaurRemoved is the data of a DinosaurRemoved event
+type DinosaurRemoved struct {
+	Dinosaur Dinosaur `json:"dinosaur"`
+	Archived bool     `json:"archived"`
+}
+
+// CageStatusChanged is the data of a CageStatusChanged event
+type CageStatusChanged struct {
+	Cage Cage   `json:"cage"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// eventBroker wakes the event streams when events are committed. The streams read the events themselves
+// from the log, so a stream that is slow or resuming sees the same events in the same order.
+type eventBroker struct {
+	mu   sync.Mutex
+	wake chan struct{}
+}
+
+func newEventBroker() *eventBroker {
+	return &eventBroker{wake: make(chan struct{})}
+}
+
+// wait returns a channel that is closed by the next notify
+func (b *eventBroker) wait() <-chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.wake
+}
+
+func (b *eventBroker) notify() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	close(b.wake)
+	b.wake = make(chan struct{})
+}
+
+// inTx runs fn in a transaction like InTx and wakes the event streams once it has committed,
+// for the changes that record events
+func (s dinoServiceImpl) inTx(ctx context.Context, fn func(repos db.Repositories) error) error {
+	err := s.dbService.InTx(ctx, func(repos db.Repositories) error {
+		pending := &pendingEvents{EventRepository: repos.Events()}
+		err := fn(deferredEvents{Repositories: repos, pending: pending})
+		if err != nil {
+			return err
+		}
+		// Appending takes a lock that keeps event ids in commit order, at the cost of letting a single
+		// writer commit at a time. The events are appended last so the lock is only held from here to
+		// the commit, not while the change itself reads and writes.
+		for _, event := range pending.events {
+			err = repos.Events().Append(ctx, event)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.events.notify()
+	return nil
+}
+
+// deferredEvents are the repositories of a transaction with the events held back until its changes are made
+type deferredEvents struct {
+	db.Repositories
+	pending *pendingEvents
+}
+
+func (r deferredEvents) Events() db.EventRepository {
+	return r.pending
+}
+
+// pendingEvents collects the events appended in a transaction, reads see the log as it is
+type pendingEvents struct {
+	db.EventRepository
+	events []ParkEvent
+}
+
+func (p *pendingEvents) Append(_ context.Context, event ParkEvent) error {
+	p.events = append(p.events, event)
+	return nil
+}
+
+// publish records an event in the transaction of the change it describes, it is appended when the change is done
+func publish(ctx context.Context, repos db.Repositories, eventType string, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return repos.Events().Append(ctx, ParkEvent{Type: eventType, Data: payload})
+}
+
+// GetEvents get the next events after the given id, oldest first
+func (s dinoServiceImpl) GetEvents(ctx context.Context, afterId int64) ([]ParkEvent, error) {
+	if afterId < 0 {
+		return nil, &ServiceRequestError{
+			err:      fmt.Sprintf("negative event id %d", afterId),
+			response: "Invalid entry for Last-Event-ID. ",
+			code:     CodeValidationFailed,
+			fields:   []FieldError{{Field: "Last-Event-ID", Rule: "gte", Param: "0"}},
+		}
+	}
+	return s.dbService.Events().List(ctx, db.ParkEventFilter{AfterId: afterId, Limit: eventBatchSize})
+}
+
+// LastEventId get the id of the latest event, a stream starting from it only sees new events
+func (s dinoServiceImpl) LastEventId(ctx context.Context) (int64, error) {
+	return s.dbService.Events().LastId(ctx)
+}
+
+// EventsCommitted returns a channel closed when events are next committed, it must be taken
+// before reading the events so none are committed unnoticed in between
+func (s dinoServiceImpl) EventsCommitted() <-chan struct{} {
+	return s.events.wait()
+}
+
+// getEventsHttp streams the park events as Server-Sent Events. A client resuming sends the id of the last event
+// it saw as Last-Event-ID, or ?after= where it cannot set headers, otherwise the stream starts with the next event.
+func getEventsHttp(source EventSource, logger *zerolog.Logger) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			logger.Error().Msg("response cannot be streamed")
+			err := render.Render(w, r, ServerError(errors.New("server error")))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+
+		lastId := r.Header.Get("Last-Event-ID")
+		if lastId == "" {
+			lastId = r.URL.Query().Get("after")
+		}
+		var afterId int64
+		var err error
+		if lastId != "" {
+			afterId, err = strconv.ParseInt(lastId, 10, 64)
+		} else {
+			afterId, err = source.LastEventId(ctx)
+		}
+		if err != nil {
+			logger.Error().Err(err).Msg("error reading last event id")
+			err := render.Render(w, r, BadRequest(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+		// the wake up is taken before each read of the log so no commit goes unnoticed in between
+		var committed <-chan struct{}
+		next := func() ([]ParkEvent, error) {
+			committed = source.EventsCommitted()
+			return source.GetEvents(ctx, afterId)
+		}
+		// a bad id is refused before the stream starts
+		events, err := next()
+		if err != nil {
+			logger.Error().Err(err).Msg("error getting events")
+			err := render.Render(w, r, errorResponse(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		keepAlive := time.NewTicker(eventKeepAlive)
+		defer keepAlive.Stop()
+		for {
+			for len(events) > 0 {
+				for _, event := range events {
+					_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Id, event.Type, event.Data)
+					if err != nil {
+						logger.Error().Err(err).Msg("error writing event")
+						return
+					}
+					afterId = event.Id
+				}
+				flusher.Flush()
+				events, err = next()
+				if err != nil {
+					// the client reconnects with the last id it saw
+					logger.Error().Err(err).Msg("error getting events")
+					return
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-committed:
+			case <-keepAlive.C:
+				_, err = fmt.Fprint(w, ": keep-alive\n\n")
+				if err != nil {
+					return
+				}
+				flusher.Flush()
+			}
+			events, err = next()
+			if err != nil {
+				logger.Error().Err(err).Msg("error getting events")
+				return
+			}
+		}
+	}
+}
@@ -1,43 +1,114 @@
 package app
 
 import (
-	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/render"
 	"github.com/rs/zerolog"
 )
 
-func NewHandler(dinoService DinoService, logger *zerolog.Logger) http.Handler {
+// NewHandler serves the v1 API. Every request must be let through by auth, which wraps the router,
+// and each route needs a role, or for an api key a scope. The responses to retried creates are kept in idempotency
+// and the event stream is read from events.
+func NewHandler(dinoService DinoService, idempotency IdempotencyStore, events EventSource, logger *zerolog.Logger, auth Authenticator) http.Handler {
+
+	readDinos := authorize(RoleViewer, ScopeDinosaursRead, logger)
+	readCages := authorize(RoleViewer, ScopeCagesRead, logger)
+	readSpecies := authorize(RoleViewer, ScopeSpeciesRead, logger)
+	readAudit := authorize(RoleViewer, ScopeAuditRead, logger)
+	readEvents := authorize(RoleViewer, ScopeEventsRead, logger)
+	// keepers look after the dinosaurs, taking them in and moving them between cages
+	moveDinos := authorize(RoleKeeper, ScopeDinosaursWrite, logger)
+	deleteDinos := authorize(RoleAdmin, ScopeDinosaursWrite, logger)
+	writeCages := authorize(RoleAdmin, ScopeCagesWrite, logger)
+	writeSpecies := authorize(RoleAdmin, ScopeSpeciesWrite, logger)
+	// no scope lets an api key manage api keys
+	manageKeys := authorize(RoleAdmin, "", logger)
+	// dinos and cages are only changed against the version the client last read
+	ifMatch := requireIfMatch(logger)
+	// creates and bulk moves can be retried safely with an Idempotency-Key
+	once := idempotent(idempotency, logger)
 
 	router := chi.NewRouter()
 	router.Route("/v1/", func(r chi.Router) {
-		r.Get("/dinosaurs", getDinosHttp(dinoService, logger))
-		r.Get("/dinosaurs/cage/{cageId}", getDinosByCageHttp(dinoService, logger))
-		r.Get("/dinosaur/{dinoId}", getDinoHttp(dinoService, logger))
-		r.Post("/dinosaur", addDinoHttp(dinoService, logger))
-		r.Put("/dinosaur/{dinoId}", updateDinoHttp(dinoService, logger))
-		r.Get("/cages", getCagesHttp(dinoService, logger))
-		r.Get("/cage/{cageId}", getCageHttp(dinoService, logger))
-		r.Post("/cage", addCageHttp(dinoService, logger))
-		r.Put("/cage/{cageId}", updateCageHttp(dinoService, logger))
+		r.With(readDinos).Get("/dinosaurs", getDinosHttp(dinoService, logger))
+		r.With(readDinos).Get("/dinosaurs/cage/{cageId}", getDinosByCageHttp(dinoService, logger))
+		r.With(readDinos).Get("/dinosaurs/placement-options", getPlacementOptionsHttp(dinoService, logger))
+		r.With(readDinos).Get("/dinosaur/{dinoId}", getDinoHttp(dinoService, logger))
+		r.With(readDinos).Get("/dinosaur/{dinoId}/placement-options", getDinoPlacementOptionsHttp(dinoService, logger))
+		r.With(readDinos).Get("/dinosaur/{dinoId}/history", getDinoHistoryHttp(dinoService, logger))
+		r.With(moveDinos, once).Post("/dinosaur", addDinoHttp(dinoService, logger))
+		r.With(moveDinos, ifMatch).Put("/dinosaur/{dinoId}", updateDinoHttp(dinoService, logger))
+		r.With(moveDinos, ifMatch).Patch("/dinosaur/{dinoId}", patchDinoHttp(dinoService, logger))
+		r.With(moveDinos, once).Post("/relocations", relocateDinosHttp(dinoService, logger))
+		r.With(deleteDinos, ifMatch).Delete("/dinosaur/{dinoId}", deleteDinoHttp(dinoService, logger))
+		r.With(readCages).Get("/cages", getCagesHttp(dinoService, logger))
+		r.With(readCages).Get("/cage/{cageId}", getCageHttp(dinoService, logger))
+		r.With(readCages).Get("/cage/{cageId}/occupancy", getCageOccupancyHttp(dinoService, logger))
+		r.With(writeCages, once).Post("/cage", addCageHttp(dinoService, logger))
+		r.With(writeCages, ifMatch).Put("/cage/{cageId}", updateCageHttp(dinoService, logger))
+		r.With(writeCages, ifMatch).Patch("/cage/{cageId}", patchCageHttp(dinoService, logger))
+		r.With(writeCages, once).Post("/cage/{cageId}/evacuate", evacuateCageHttp(dinoService, logger))
+		r.With(writeCages, ifMatch).Delete("/cage/{cageId}", deleteCageHttp(dinoService, logger))
+		r.With(readSpecies).Get("/species", getSpeciesHttp(dinoService, logger))
+		r.With(readSpecies).Get("/species/{name}", getSpeciesByNameHttp(dinoService, logger))
+		r.With(writeSpecies).Post("/species", addSpeciesHttp(dinoService, logger))
+		r.With(writeSpecies).Put("/species/{name}", updateSpeciesHttp(dinoService, logger))
+		r.With(writeSpecies).Delete("/species/{name}", deleteSpeciesHttp(dinoService, logger))
+		r.With(readAudit).Get("/audit", getAuditHttp(dinoService, logger))
+		r.With(readEvents).Get("/events", getEventsHttp(events, logger))
+		r.With(manageKeys).Get("/api-keys", getAPIKeysHttp(dinoService, logger))
+		r.With(manageKeys).Post("/api-keys", createAPIKeyHttp(dinoService, logger))
+		r.With(manageKeys).Put("/api-keys/{keyId}", updateAPIKeyHttp(dinoService, logger))
+		r.With(manageKeys).Delete("/api-keys/{keyId}", revokeAPIKeyHttp(dinoService, logger))
 	})
-	return router
+	return authenticate(auth, logger)(router)
 }
 
-// getDinosHttp gets all dinosaurs and returns result as json
+// getDinosHttp gets a page of dinosaurs, filtered by ?species=, ?diet= and ?cage_id=, and returns result as json
 func getDinosHttp(dinoService DinoService, logger *zerolog.Logger) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		dinos, err := dinoService.GetDinos(r.Context())
+		query := r.URL.Query()
+		filter := DinoFilter{
+			Species: query.Get("species"),
+			Diet:    query.Get("diet"),
+		}
+		if query.Has("cage_id") {
+			cageId, err := strconv.ParseInt(query.Get("cage_id"), 10, 64)
+			if err != nil {
+				logger.Error().Err(err).Msg("error parsing cage_id")
+				err := render.Render(w, r, BadRequest(err))
+				if err != nil {
+					logger.Error().Err(err).Msg("render error")
+				}
+				return
+			}
+			filter.CageId = cageId
+		}
+
+		page, err := pageRequest(r)
+		if err != nil {
+			logger.Error().Err(err).Msg("error parsing limit")
+			err := render.Render(w, r, BadRequest(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+
+		dinos, err := dinoService.GetDinos(r.Context(), filter, page)
 		if err != nil {
 			logger.Error().Err(err).Msg("error getting dino")
-			err = render.Render(w, r, ServerError(errors.New("server error")))
+			err := render.Render(w, r, errorResponse(err))
 			if err != nil {
 				logger.Error().Err(err).Msg("render error")
 			}
@@ -54,30 +125,32 @@ func getDinosHttp(dinoService DinoService, logger *zerolog.Logger) func(w http.R
 	}
 }
 
-// getDinosByCageHttp gets all dinosaurs by cageId and returns result as json
+// getDinosByCageHttp gets a page of dinosaurs by cageId and returns result as json
 func getDinosByCageHttp(dinoService DinoService, logger *zerolog.Logger) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		cageId, _ := url.PathUnescape(chi.URLParam(r, "cageId"))
 		id, err := strconv.ParseInt(cageId, 10, 64)
 		if err != nil {
-			logger.Error().Err(err).Msg("error getting cageId")
-			err := render.Render(w, r, ServerError(errors.New("server error")))
+			logger.Error().Err(err).Msg("error parsing cageId")
+			err := render.Render(w, r, BadRequest(err))
 			if err != nil {
 				logger.Error().Err(err).Msg("render error")
 			}
 			return
 		}
-		dinos, err := dinoService.GetDinosByCage(r.Context(), id)
+		page, err := pageRequest(r)
 		if err != nil {
-			logger.Error().Err(err).Msg("error getting dinos by cage")
-			if errors.Is(err, sql.ErrNoRows) {
-				err := render.Render(w, r, NotFound(errors.New("not found")))
-				if err != nil {
-					logger.Error().Err(err).Msg("render error")
-				}
-				return
+			logger.Error().Err(err).Msg("error parsing limit")
+			err := render.Render(w, r, BadRequest(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
 			}
-			err := render.Render(w, r, ServerError(errors.New("server error")))
+			return
+		}
+		dinos, err := dinoService.GetDinosByCage(r.Context(), id, page)
+		if err != nil {
+			logger.Error().Err(err).Msg("error getting dinos by cage")
+			err := render.Render(w, r, errorResponse(err))
 			if err != nil {
 				logger.Error().Err(err).Msg("render error")
 			}
@@ -111,19 +184,15 @@ func getDinoHttp(dinoService DinoService, logger *zerolog.Logger) func(w http.Re
 		dino, err := dinoService.GetDinoById(r.Context(), id)
 		if err != nil {
 			logger.Error().Err(err).Msg("error getting dino")
-			if errors.Is(err, sql.ErrNoRows) {
-				err := render.Render(w, r, NotFound(errors.New("not found")))
-				if err != nil {
-					logger.Error().Err(err).Msg("render error")
-				}
-				return
-			}
-			err := render.Render(w, r, ServerError(errors.New("server error")))
+			err := render.Render(w, r, errorResponse(err))
 			if err != nil {
 				logger.Error().Err(err).Msg("render error")
 			}
 			return
 		}
+		if notModified(w, r, dinoETag(dino)) {
+			return
+		}
 		err = respondwithJSON(w, http.StatusOK, &dino)
 		if err != nil {
 			logger.Error().Err(err).Msg("error getting dino")
@@ -136,6 +205,64 @@ func getDinoHttp(dinoService DinoService, logger *zerolog.Logger) func(w http.Re
 	}
 }
 
+// getPlacementOptionsHttp lists the cages that would accept a new dino of ?species=, and why the others would not
+func getPlacementOptionsHttp(dinoService DinoService, logger *zerolog.Logger) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		options, err := dinoService.GetPlacementOptions(r.Context(), r.URL.Query().Get("species"))
+		if err != nil {
+			logger.Error().Err(err).Msg("error getting placement options")
+			err := render.Render(w, r, errorResponse(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+		err = respondwithJSON(w, http.StatusOK, options)
+		if err != nil {
+			logger.Error().Err(err).Msg("error getting placement options")
+			err := render.Render(w, r, ServerError(errors.New("server error")))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+	}
+}
+
+// getDinoPlacementOptionsHttp lists the cages a dino could be moved to, and why the others would refuse it
+func getDinoPlacementOptionsHttp(dinoService DinoService, logger *zerolog.Logger) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dinoId, _ := url.PathUnescape(chi.URLParam(r, "dinoId"))
+		id, err := strconv.ParseInt(dinoId, 10, 64)
+		if err != nil {
+			logger.Error().Err(err).Msg("error parsing dinoId")
+			err := render.Render(w, r, BadRequest(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+		options, err := dinoService.GetDinoPlacementOptions(r.Context(), id)
+		if err != nil {
+			logger.Error().Err(err).Msg("error getting placement options")
+			err := render.Render(w, r, errorResponse(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+		err = respondwithJSON(w, http.StatusOK, options)
+		if err != nil {
+			logger.Error().Err(err).Msg("error getting placement options")
+			err := render.Render(w, r, ServerError(errors.New("server error")))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+	}
+}
+
 // getCageHttp gets cage by cageId and returns result as json
 func getCageHttp(dinoService DinoService, logger *zerolog.Logger) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -152,19 +279,15 @@ func getCageHttp(dinoService DinoService, logger *zerolog.Logger) func(w http.Re
 		cage, err := dinoService.GetCageById(r.Context(), id)
 		if err != nil {
 			logger.Error().Err(err).Msg("error getting cage")
-			if errors.Is(err, sql.ErrNoRows) {
-				err := render.Render(w, r, NotFound(errors.New("not found")))
-				if err != nil {
-					logger.Error().Err(err).Msg("render error")
-				}
-				return
-			}
-			err := render.Render(w, r, ServerError(errors.New("server error")))
+			err := render.Render(w, r, errorResponse(err))
 			if err != nil {
 				logger.Error().Err(err).Msg("render error")
 			}
 			return
 		}
+		if notModified(w, r, cageETag(cage)) {
+			return
+		}
 		err = respondwithJSON(w, http.StatusOK, &cage)
 		if err != nil {
 			logger.Error().Err(err).Msg("error getting cage")
@@ -202,25 +325,19 @@ func addDinoHttp(dinoService DinoService, logger *zerolog.Logger) func(w http.Re
 			return
 		}
 
-		err = dinoService.AddDino(ctx, dino)
+		created, err := dinoService.AddDino(ctx, dino)
 		if err != nil {
 			logger.Error().Err(err).Msg("error saving dino")
-			var serviceErr *ServiceRequestError
-			if errors.As(err, &serviceErr) {
-				err := render.Render(w, r, BadRequest(errors.New(err.(*ServiceRequestError).response)))
-				if err != nil {
-					logger.Error().Err(err).Msg("render error")
-				}
-			} else {
-				err := render.Render(w, r, ServerError(errors.New("server error")))
-				if err != nil {
-					logger.Error().Err(err).Msg("render error")
-				}
+			err := render.Render(w, r, errorResponse(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
 			}
 			return
 		}
 
-		err = respondwithJSON(w, http.StatusCreated, "{}")
+		w.Header().Set("Location", fmt.Sprintf("/v1/dinosaur/%d", created.Id))
+		w.Header().Set("ETag", dinoETag(created))
+		err = respondwithJSON(w, http.StatusCreated, &created)
 		if err != nil {
 			err := render.Render(w, r, ServerError(err))
 			if err != nil {
@@ -257,25 +374,19 @@ func addCageHttp(dinoService DinoService, logger *zerolog.Logger) func(w http.Re
 			return
 		}
 
-		err = dinoService.AddCage(ctx, cage)
+		created, err := dinoService.AddCage(ctx, cage)
 		if err != nil {
 			logger.Error().Err(err).Msg("error saving cage")
-			var serviceErr *ServiceRequestError
-			if errors.As(err, &serviceErr) {
-				err := render.Render(w, r, BadRequest(errors.New(err.(*ServiceRequestError).response)))
-				if err != nil {
-					logger.Error().Err(err).Msg("render error")
-				}
-			} else {
-				err := render.Render(w, r, ServerError(errors.New("server error")))
-				if err != nil {
-					logger.Error().Err(err).Msg("render error")
-				}
+			err := render.Render(w, r, errorResponse(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
 			}
 			return
 		}
 
-		err = respondwithJSON(w, http.StatusCreated, "{}")
+		w.Header().Set("Location", fmt.Sprintf("/v1/cage/%d", created.Id))
+		w.Header().Set("ETag", cageETag(created))
+		err = respondwithJSON(w, http.StatusCreated, &created)
 		if err != nil {
 			err := render.Render(w, r, ServerError(err))
 			if err != nil {
@@ -286,13 +397,25 @@ func addCageHttp(dinoService DinoService, logger *zerolog.Logger) func(w http.Re
 	}
 }
 
-// getCagesHttp gets all cages and returns result as json
+// getCagesHttp gets a page of cages, filtered by ?status=, and returns result as json
 func getCagesHttp(dinoService DinoService, logger *zerolog.Logger) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		cages, err := dinoService.GetCages(r.Context())
+		filter := CageFilter{
+			Status: r.URL.Query().Get("status"),
+		}
+		page, err := pageRequest(r)
+		if err != nil {
+			logger.Error().Err(err).Msg("error parsing limit")
+			err := render.Render(w, r, BadRequest(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+		cages, err := dinoService.GetCages(r.Context(), filter, page)
 		if err != nil {
 			logger.Error().Err(err).Msg("error getting cages")
-			err := render.Render(w, r, ServerError(errors.New("server error")))
+			err := render.Render(w, r, errorResponse(err))
 			if err != nil {
 				logger.Error().Err(err).Msg("render error")
 			}
@@ -347,25 +470,67 @@ func updateCageHttp(dinoService DinoService, logger *zerolog.Logger) func(w http
 		}
 		cage.Id = id
 
-		err = dinoService.UpdateCage(ctx, cage)
+		updated, err := dinoService.UpdateCage(ctx, cage)
 		if err != nil {
 			logger.Error().Err(err).Msg("error updating cage")
-			var serviceErr *ServiceRequestError
-			if errors.As(err, &serviceErr) {
-				err := render.Render(w, r, BadRequest(errors.New(err.(*ServiceRequestError).response)))
-				if err != nil {
-					logger.Error().Err(err).Msg("render error")
-				}
-			} else {
-				err := render.Render(w, r, ServerError(errors.New("server error")))
+			err := render.Render(w, r, errorResponse(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+
+		w.Header().Set("ETag", cageETag(updated))
+		err = respondwithJSON(w, http.StatusOK, &updated)
+		if err != nil {
+			err := render.Render(w, r, ServerError(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+	}
+}
+
+// evacuateCageHttp moves the dinos of a cage into other ACTIVE cages and marks it DOWN,
+// ?dry_run=true only returns the plan
+func evacuateCageHttp(dinoService DinoService, logger *zerolog.Logger) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cageId, _ := url.PathUnescape(chi.URLParam(r, "cageId"))
+		id, err := strconv.ParseInt(cageId, 10, 64)
+		if err != nil {
+			logger.Error().Err(err).Msg("error parsing cageId")
+			err := render.Render(w, r, BadRequest(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+
+		dryRun := false
+		if r.URL.Query().Has("dry_run") {
+			dryRun, err = strconv.ParseBool(r.URL.Query().Get("dry_run"))
+			if err != nil {
+				logger.Error().Err(err).Msg("error parsing dry_run")
+				err := render.Render(w, r, BadRequest(err))
 				if err != nil {
 					logger.Error().Err(err).Msg("render error")
 				}
+				return
+			}
+		}
+
+		plan, err := dinoService.EvacuateCage(r.Context(), id, dryRun)
+		if err != nil {
+			logger.Error().Err(err).Msg("error evacuating cage")
+			err := render.Render(w, r, errorResponse(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
 			}
 			return
 		}
 
-		err = respondwithJSON(w, http.StatusOK, "{}")
+		err = respondwithJSON(w, http.StatusOK, plan)
 		if err != nil {
 			err := render.Render(w, r, ServerError(err))
 			if err != nil {
@@ -412,33 +577,771 @@ func updateDinoHttp(dinoService DinoService, logger *zerolog.Logger) func(w http
 			return
 		}
 		dino.Id = id
-		err = dinoService.UpdateDino(ctx, dino)
+		updated, err := dinoService.UpdateDino(ctx, dino)
 		if err != nil {
 			logger.Error().Err(err).Msg("error updating dino")
-			var serviceErr *ServiceRequestError
-			if errors.As(err, &serviceErr) {
-				err := render.Render(w, r, BadRequest(errors.New(err.(*ServiceRequestError).response)))
+			err := render.Render(w, r, errorResponse(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+
+		w.Header().Set("ETag", dinoETag(updated))
+		err = respondwithJSON(w, http.StatusOK, &updated)
+		if err != nil {
+			err := render.Render(w, r, ServerError(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+	}
+}
+
+// relocateDinosHttp moves many dinos between cages at once, either every move is made or none are
+func relocateDinosHttp(dinoService DinoService, logger *zerolog.Logger) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		defer r.Body.Close()
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			logger.Error().Err(err).Msg("error reading request data")
+			err := render.Render(w, r, BadRequest(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+		plan := RelocationPlan{}
+		err = json.Unmarshal(body, &plan)
+		if err != nil {
+			logger.Error().Err(err).Msg("error reading request data into relocation plan struct")
+			err := render.Render(w, r, BadRequest(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+
+		err = dinoService.RelocateDinos(ctx, plan)
+		if err != nil {
+			logger.Error().Err(err).Msg("error relocating dinos")
+			err := render.Render(w, r, errorResponse(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+
+		err = respondwithJSON(w, http.StatusOK, &plan)
+		if err != nil {
+			err := render.Render(w, r, ServerError(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+	}
+}
+
+// deleteDinoHttp deletes a dino by id, ?archive=true keeps it for history
+func deleteDinoHttp(dinoService DinoService, logger *zerolog.Logger) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dinoId, _ := url.PathUnescape(chi.URLParam(r, "dinoId"))
+		id, err := strconv.ParseInt(dinoId, 10, 64)
+		if err != nil {
+			logger.Error().Err(err).Msg("error parsing dinoId")
+			err := render.Render(w, r, BadRequest(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+
+		// a value that is not understood is refused rather than taken as a hard delete
+		archive := false
+		if r.URL.Query().Has("archive") {
+			archive, err = strconv.ParseBool(r.URL.Query().Get("archive"))
+			if err != nil {
+				logger.Error().Err(err).Msg("error parsing archive")
+				err := render.Render(w, r, BadRequest(err))
 				if err != nil {
 					logger.Error().Err(err).Msg("render error")
 				}
-			} else {
-				err := render.Render(w, r, ServerError(errors.New("server error")))
+				return
+			}
+		}
+		err = dinoService.DeleteDino(r.Context(), id, archive)
+		if err != nil {
+			logger.Error().Err(err).Msg("error deleting dino")
+			err := render.Render(w, r, errorResponse(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// deleteCageHttp deletes an empty cage by cageId, ?archive=true keeps it for history
+func deleteCageHttp(dinoService DinoService, logger *zerolog.Logger) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cageId, _ := url.PathUnescape(chi.URLParam(r, "cageId"))
+		id, err := strconv.ParseInt(cageId, 10, 64)
+		if err != nil {
+			logger.Error().Err(err).Msg("error parsing cageId")
+			err := render.Render(w, r, BadRequest(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+
+		// a value that is not understood is refused rather than taken as a hard delete
+		archive := false
+		if r.URL.Query().Has("archive") {
+			archive, err = strconv.ParseBool(r.URL.Query().Get("archive"))
+			if err != nil {
+				logger.Error().Err(err).Msg("error parsing archive")
+				err := render.Render(w, r, BadRequest(err))
 				if err != nil {
 					logger.Error().Err(err).Msg("render error")
 				}
+				return
 			}
-			return
 		}
-
-		err = respondwithJSON(w, http.StatusOK, "{}")
+		err = dinoService.DeleteCage(r.Context(), id, archive)
 		if err != nil {
-			err := render.Render(w, r, ServerError(err))
+			logger.Error().Err(err).Msg("error deleting cage")
+			err := render.Render(w, r, errorResponse(err))
 			if err != nil {
 				logger.Error().Err(err).Msg("render error")
 			}
 			return
 		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// getSpeciesHttp gets a page of species and returns result as json
+func getSpeciesHttp(dinoService DinoService, logger *zerolog.Logger) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page, err := pageRequest(r)
+		if err != nil {
+			logger.Error().Err(err).Msg("error parsing limit")
+			err := render.Render(w, r, BadRequest(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+		species, err := dinoService.GetSpecies(r.Context(), page)
+		if err != nil {
+			logger.Error().Err(err).Msg("error getting species")
+			err := render.Render(w, r, errorResponse(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+		err = respondwithJSON(w, http.StatusOK, &species)
+		if err != nil {
+			logger.Error().Err(err).Msg("error getting species")
+			err := render.Render(w, r, ServerError(errors.New("server error")))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+	}
+}
+
+// getSpeciesByNameHttp gets a species by name and returns result as json
+func getSpeciesByNameHttp(dinoService DinoService, logger *zerolog.Logger) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name, _ := url.PathUnescape(chi.URLParam(r, "name"))
+		species, err := dinoService.GetSpeciesByName(r.Context(), name)
+		if err != nil {
+			logger.Error().Err(err).Msg("error getting species")
+			err := render.Render(w, r, errorResponse(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+		err = respondwithJSON(w, http.StatusOK, &species)
+		if err != nil {
+			logger.Error().Err(err).Msg("error getting species")
+			err := render.Render(w, r, ServerError(errors.New("server error")))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+	}
+}
+
+// addSpeciesHttp adds a new species to the db
+func addSpeciesHttp(dinoService DinoService, logger *zerolog.Logger) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		defer r.Body.Close()
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			logger.Error().Err(err).Msg("error reading request data")
+			err := render.Render(w, r, BadRequest(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+		species := Species{}
+		err = json.Unmarshal(body, &species)
+		if err != nil {
+			logger.Error().Err(err).Msg("error reading request data into species struct")
+			err := render.Render(w, r, BadRequest(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+
+		created, err := dinoService.AddSpecies(ctx, species)
+		if err != nil {
+			logger.Error().Err(err).Msg("error saving species")
+			err := render.Render(w, r, errorResponse(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+
+		w.Header().Set("Location", "/v1/species/"+url.PathEscape(created.Name))
+		err = respondwithJSON(w, http.StatusCreated, &created)
+		if err != nil {
+			err := render.Render(w, r, ServerError(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+	}
+}
+
+// updateSpeciesHttp updates the diet of a species by name
+func updateSpeciesHttp(dinoService DinoService, logger *zerolog.Logger) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name, _ := url.PathUnescape(chi.URLParam(r, "name"))
+
+		ctx := r.Context()
+		defer r.Body.Close()
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			logger.Error().Err(err).Msg("error reading request data")
+			err := render.Render(w, r, BadRequest(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+		species := Species{}
+		err = json.Unmarshal(body, &species)
+		if err != nil {
+			logger.Error().Err(err).Msg("error reading request data into species struct")
+			err := render.Render(w, r, BadRequest(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+		species.Name = name
+
+		updated, err := dinoService.UpdateSpecies(ctx, species)
+		if err != nil {
+			logger.Error().Err(err).Msg("error updating species")
+			err := render.Render(w, r, errorResponse(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+
+		err = respondwithJSON(w, http.StatusOK, &updated)
+		if err != nil {
+			err := render.Render(w, r, ServerError(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+	}
+}
+
+// deleteSpeciesHttp deletes a species no dino has been recorded as
+func deleteSpeciesHttp(dinoService DinoService, logger *zerolog.Logger) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name, _ := url.PathUnescape(chi.URLParam(r, "name"))
+
+		err := dinoService.DeleteSpecies(r.Context(), name)
+		if err != nil {
+			logger.Error().Err(err).Msg("error deleting species")
+			err := render.Render(w, r, errorResponse(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// getDinoHistoryHttp gets a page of the cages a dino has been in and returns result as json
+func getDinoHistoryHttp(dinoService DinoService, logger *zerolog.Logger) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dinoId, _ := url.PathUnescape(chi.URLParam(r, "dinoId"))
+		id, err := strconv.ParseInt(dinoId, 10, 64)
+		if err != nil {
+			logger.Error().Err(err).Msg("error parsing dinoId")
+			err := render.Render(w, r, BadRequest(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+		page, err := pageRequest(r)
+		if err != nil {
+			logger.Error().Err(err).Msg("error parsing limit")
+			err := render.Render(w, r, BadRequest(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+		history, err := dinoService.GetDinoHistory(r.Context(), id, page)
+		if err != nil {
+			logger.Error().Err(err).Msg("error getting dino history")
+			err := render.Render(w, r, errorResponse(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+		err = respondwithJSON(w, http.StatusOK, &history)
+		if err != nil {
+			logger.Error().Err(err).Msg("error getting dino history")
+			err := render.Render(w, r, ServerError(errors.New("server error")))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+	}
+}
+
+// getCageOccupancyHttp gets the dinos that were in a cage at ?at=, now when it is not given, and returns result as json
+func getCageOccupancyHttp(dinoService DinoService, logger *zerolog.Logger) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cageId, _ := url.PathUnescape(chi.URLParam(r, "cageId"))
+		id, err := strconv.ParseInt(cageId, 10, 64)
+		if err != nil {
+			logger.Error().Err(err).Msg("error parsing cageId")
+			err := render.Render(w, r, BadRequest(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+		at := time.Now().UTC()
+		if r.URL.Query().Has("at") {
+			at, err = time.Parse(time.RFC3339, r.URL.Query().Get("at"))
+			if err != nil {
+				logger.Error().Err(err).Msg("error parsing at")
+				err := render.Render(w, r, BadRequest(err))
+				if err != nil {
+					logger.Error().Err(err).Msg("render error")
+				}
+				return
+			}
+		}
+		occupancy, err := dinoService.GetCageOccupancy(r.Context(), id, at)
+		if err != nil {
+			logger.Error().Err(err).Msg("error getting cage occupancy")
+			err := render.Render(w, r, errorResponse(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+		err = respondwithJSON(w, http.StatusOK, &occupancy)
+		if err != nil {
+			logger.Error().Err(err).Msg("error getting cage occupancy")
+			err := render.Render(w, r, ServerError(errors.New("server error")))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+	}
+}
+
+// getAuditHttp gets a page of the audit log, filtered by ?entity=, ?id=, ?from= and ?to=, and returns result as json
+func getAuditHttp(dinoService DinoService, logger *zerolog.Logger) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, err := auditFilter(r)
+		if err != nil {
+			logger.Error().Err(err).Msg("error parsing audit filter")
+			err := render.Render(w, r, BadRequest(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+		page, err := pageRequest(r)
+		if err != nil {
+			logger.Error().Err(err).Msg("error parsing limit")
+			err := render.Render(w, r, BadRequest(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+		events, err := dinoService.GetAuditEvents(r.Context(), filter, page)
+		if err != nil {
+			logger.Error().Err(err).Msg("error getting audit events")
+			err := render.Render(w, r, errorResponse(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+		err = respondwithJSON(w, http.StatusOK, &events)
+		if err != nil {
+			logger.Error().Err(err).Msg("error getting audit events")
+			err := render.Render(w, r, ServerError(errors.New("server error")))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+	}
+}
+
+// getAPIKeysHttp lists the api keys, the keys themselves are never shown
+func getAPIKeysHttp(dinoService DinoService, logger *zerolog.Logger) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page, err := pageRequest(r)
+		if err != nil {
+			logger.Error().Err(err).Msg("error parsing limit")
+			err := render.Render(w, r, BadRequest(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+		keys, err := dinoService.GetAPIKeys(r.Context(), page)
+		if err != nil {
+			logger.Error().Err(err).Msg("error getting api keys")
+			err := render.Render(w, r, errorResponse(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+		err = respondwithJSON(w, http.StatusOK, &keys)
+		if err != nil {
+			logger.Error().Err(err).Msg("error getting api keys")
+			err := render.Render(w, r, ServerError(errors.New("server error")))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+	}
+}
+
+// createAPIKeyHttp mints an api key, the response is the only time the key is shown
+func createAPIKeyHttp(dinoService DinoService, logger *zerolog.Logger) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		defer r.Body.Close()
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			logger.Error().Err(err).Msg("error reading request data")
+			err := render.Render(w, r, BadRequest(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+		key := NewAPIKey{}
+		err = json.Unmarshal(body, &key)
+		if err != nil {
+			logger.Error().Err(err).Msg("error reading request data into api key struct")
+			err := render.Render(w, r, BadRequest(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+
+		minted, err := dinoService.CreateAPIKey(ctx, key)
+		if err != nil {
+			logger.Error().Err(err).Msg("error creating api key")
+			err := render.Render(w, r, errorResponse(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+
+		err = respondwithJSON(w, http.StatusCreated, &minted)
+		if err != nil {
+			err := render.Render(w, r, ServerError(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+	}
+}
+
+// updateAPIKeyHttp replaces the scopes of an api key
+func updateAPIKeyHttp(dinoService DinoService, logger *zerolog.Logger) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		keyId, _ := url.PathUnescape(chi.URLParam(r, "keyId"))
+		id, err := strconv.ParseInt(keyId, 10, 64)
+		if err != nil {
+			logger.Error().Err(err).Msg("error parsing keyId")
+			err := render.Render(w, r, BadRequest(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+
+		ctx := r.Context()
+		defer r.Body.Close()
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			logger.Error().Err(err).Msg("error reading request data")
+			err := render.Render(w, r, BadRequest(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+		scopes := APIKeyScopes{}
+		err = json.Unmarshal(body, &scopes)
+		if err != nil {
+			logger.Error().Err(err).Msg("error reading request data into api key scopes struct")
+			err := render.Render(w, r, BadRequest(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+
+		updated, err := dinoService.UpdateAPIKeyScopes(ctx, id, scopes)
+		if err != nil {
+			logger.Error().Err(err).Msg("error updating api key")
+			err := render.Render(w, r, errorResponse(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+
+		err = respondwithJSON(w, http.StatusOK, &updated)
+		if err != nil {
+			err := render.Render(w, r, ServerError(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+	}
+}
+
+// revokeAPIKeyHttp revokes an api key, it stays in the list marked with when it was revoked
+func revokeAPIKeyHttp(dinoService DinoService, logger *zerolog.Logger) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		keyId, _ := url.PathUnescape(chi.URLParam(r, "keyId"))
+		id, err := strconv.ParseInt(keyId, 10, 64)
+		if err != nil {
+			logger.Error().Err(err).Msg("error parsing keyId")
+			err := render.Render(w, r, BadRequest(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+
+		err = dinoService.RevokeAPIKey(r.Context(), id)
+		if err != nil {
+			logger.Error().Err(err).Msg("error revoking api key")
+			err := render.Render(w, r, errorResponse(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// patchDinoHttp applies a JSON merge patch to a dino by id
+func patchDinoHttp(dinoService DinoService, logger *zerolog.Logger) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dinoId, _ := url.PathUnescape(chi.URLParam(r, "dinoId"))
+		id, err := strconv.ParseInt(dinoId, 10, 64)
+		if err != nil {
+			logger.Error().Err(err).Msg("error parsing dinoId")
+			err := render.Render(w, r, BadRequest(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+
+		patch, errResp := mergePatchBody(r)
+		if errResp != nil {
+			logger.Error().Err(errResp.Err).Msg("error reading merge patch")
+			err := render.Render(w, r, errResp)
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+		updated, err := dinoService.PatchDino(r.Context(), id, patch)
+		if err != nil {
+			logger.Error().Err(err).Msg("error patching dino")
+			err := render.Render(w, r, errorResponse(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+
+		w.Header().Set("ETag", dinoETag(updated))
+		err = respondwithJSON(w, http.StatusOK, &updated)
+		if err != nil {
+			err := render.Render(w, r, ServerError(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+	}
+}
+
+// patchCageHttp applies a JSON merge patch to a cage by id
+func patchCageHttp(dinoService DinoService, logger *zerolog.Logger) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cageId, _ := url.PathUnescape(chi.URLParam(r, "cageId"))
+		id, err := strconv.ParseInt(cageId, 10, 64)
+		if err != nil {
+			logger.Error().Err(err).Msg("error parsing cageId")
+			err := render.Render(w, r, BadRequest(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+
+		patch, errResp := mergePatchBody(r)
+		if errResp != nil {
+			logger.Error().Err(errResp.Err).Msg("error reading merge patch")
+			err := render.Render(w, r, errResp)
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+		updated, err := dinoService.PatchCage(r.Context(), id, patch)
+		if err != nil {
+			logger.Error().Err(err).Msg("error patching cage")
+			err := render.Render(w, r, errorResponse(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+
+		w.Header().Set("ETag", cageETag(updated))
+		err = respondwithJSON(w, http.StatusOK, &updated)
+		if err != nil {
+			err := render.Render(w, r, ServerError(err))
+			if err != nil {
+				logger.Error().Err(err).Msg("render error")
+			}
+			return
+		}
+	}
+}
+
+// mergePatchBody reads the body of a PATCH, which must be sent as application/merge-patch+json
+// or plain application/json, returning the response to send when it cannot be read
+func mergePatchBody(r *http.Request) (json.RawMessage, *ErrorResponse) {
+	contentType, _, _ := strings.Cut(r.Header.Get("Content-Type"), ";")
+	contentType = strings.TrimSpace(contentType)
+	if contentType != mergePatchContentType && contentType != "application/json" {
+		return nil, UnsupportedMediaType(fmt.Errorf("a PATCH body must be sent as %s", mergePatchContentType))
+	}
+	defer r.Body.Close()
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, BadRequest(err)
+	}
+	if !json.Valid(body) {
+		return nil, BadRequest(errors.New("the patch is not valid JSON"))
+	}
+	return body, nil
+}
+
+// auditFilter reads the ?entity=, ?id=, ?from= and ?to= query parameters, times are RFC 3339
+func auditFilter(r *http.Request) (AuditFilter, error) {
+	query := r.URL.Query()
+	filter := AuditFilter{Entity: query.Get("entity")}
+	var err error
+	if query.Has("id") {
+		filter.EntityId, err = strconv.ParseInt(query.Get("id"), 10, 64)
+		if err != nil {
+			return filter, err
+		}
+	}
+	if query.Has("from") {
+		filter.From, err = time.Parse(time.RFC3339, query.Get("from"))
+		if err != nil {
+			return filter, err
+		}
+	}
+	if query.Has("to") {
+		filter.To, err = time.Parse(time.RFC3339, query.Get("to"))
+		if err != nil {
+			return filter, err
+		}
+	}
+	return filter, nil
+}
+
+// pageRequest reads the ?limit= and ?cursor= query parameters of a list endpoint
+func pageRequest(r *http.Request) (PageRequest, error) {
+	query := r.URL.Query()
+	page := PageRequest{Cursor: query.Get("cursor")}
+	if query.Has("limit") {
+		limit, err := strconv.Atoi(query.Get("limit"))
+		if err != nil {
+			return page, err
+		}
+		page.Limit = limit
 	}
+	return page, nil
 }
 
 func respondwithJSON(w http.ResponseWriter, code int, payload interface{}) error {
@@ -0,0 +1,703 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Handler_Get_Cage(t *testing.T) {
+
+	asserter := assert.New(t)
+
+	server := newTestServer()
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/v1/cage/1")
+	asserter.NoError(err)
+	defer resp.Body.Close()
+	asserter.Equal(http.StatusOK, resp.StatusCode)
+
+	cage := Cage{}
+	asserter.NoError(json.NewDecoder(resp.Body).Decode(&cage))
+	asserter.Equal("Cage One", cage.Name)
+	asserter.Equal(int64(2), cage.Occupancy)
+	asserter.Equal(int64(2), cage.RemainingSlots)
+
+	resp, err = http.Get(server.URL + "/v1/cage/99")
+	asserter.NoError(err)
+	resp.Body.Close()
+	asserter.Equal(http.StatusNotFound, resp.StatusCode)
+}
+
+func Test_Handler_Add_Dino(t *testing.T) {
+
+	asserter := assert.New(t)
+
+	server := newTestServer()
+	defer server.Close()
+
+	body := `{"cage_id": 2, "dino_name": "Cera", "dino_species": "Triceratops"}`
+	resp, err := http.Post(server.URL+"/v1/dinosaur", "application/json", strings.NewReader(body))
+	asserter.NoError(err)
+	asserter.Equal(http.StatusCreated, resp.StatusCode)
+	created := Dinosaur{}
+	asserter.NoError(json.NewDecoder(resp.Body).Decode(&created))
+	resp.Body.Close()
+	asserter.NotZero(created.Id)
+	asserter.Equal(Dinosaur{Id: created.Id, CageId: 2, Name: "Cera", Species: "Triceratops", Version: 1}, created)
+	asserter.Equal("/v1/dinosaur/"+strconv.FormatInt(created.Id, 10), resp.Header.Get("Location"))
+	asserter.Equal(`"1"`, resp.Header.Get("ETag"))
+
+	resp, err = http.Get(server.URL + resp.Header.Get("Location"))
+	asserter.NoError(err)
+	resp.Body.Close()
+	asserter.Equal(http.StatusOK, resp.StatusCode)
+
+	// a herbivore cannot join the Tyrannosaurus in Cage One
+	body = `{"cage_id": 1, "dino_name": "Cera", "dino_species": "Triceratops"}`
+	resp, err = http.Post(server.URL+"/v1/dinosaur", "application/json", strings.NewReader(body))
+	asserter.NoError(err)
+	defer resp.Body.Close()
+	asserter.Equal(http.StatusBadRequest, resp.StatusCode)
+
+	asserter.Equal("application/problem+json", resp.Header.Get("Content-Type"))
+	errResp := ErrorResponse{}
+	asserter.NoError(json.NewDecoder(resp.Body).Decode(&errResp))
+	asserter.Equal(CodeSpeciesConflict, errResp.Code)
+	asserter.Equal(http.StatusBadRequest, errResp.Status)
+	asserter.Equal("/v1/dinosaur", errResp.Instance)
+	asserter.Contains(errResp.Detail, "This dinosaur is not allowed to be put in this cage")
+	asserter.Equal([]RuleViolation{{
+		Rule:   "diet_separation",
+		Code:   CodeSpeciesConflict,
+		Reason: "A herbivore cannot share a cage with Maggie the Tyrannosaurus",
+	}}, errResp.Violations)
+}
+
+func Test_Handler_Add_and_Update_Cage(t *testing.T) {
+
+	asserter := assert.New(t)
+
+	server := newTestServer()
+	defer server.Close()
+
+	body := `{"cage_name": "test_cage", "cage_status": "ACTIVE", "max_capacity": 2}`
+	resp, err := http.Post(server.URL+"/v1/cage", "application/json", strings.NewReader(body))
+	asserter.NoError(err)
+	asserter.Equal(http.StatusCreated, resp.StatusCode)
+	cage := Cage{}
+	asserter.NoError(json.NewDecoder(resp.Body).Decode(&cage))
+	resp.Body.Close()
+	asserter.Equal("/v1/cage/"+strconv.FormatInt(cage.Id, 10), resp.Header.Get("Location"))
+	asserter.Equal(Cage{Id: cage.Id, Name: "test_cage", Status: CageStatusActive, MaxCapacity: 2, RemainingSlots: 2, Version: 1}, cage)
+
+	// the update comes back as stored, occupancy included
+	body = `{"cage_name": "Cage One", "cage_status": "ACTIVE", "max_capacity": 3}`
+	req, err := http.NewRequest(http.MethodPut, server.URL+"/v1/cage/1", strings.NewReader(body))
+	asserter.NoError(err)
+	req.Header.Set("If-Match", `"1-2"`)
+	resp, err = http.DefaultClient.Do(req)
+	asserter.NoError(err)
+	defer resp.Body.Close()
+	asserter.Equal(http.StatusOK, resp.StatusCode)
+	asserter.Equal(`"2-2"`, resp.Header.Get("ETag"))
+	cage = Cage{}
+	asserter.NoError(json.NewDecoder(resp.Body).Decode(&cage))
+	asserter.Equal(Cage{Id: 1, Name: "Cage One", Status: CageStatusActive, MaxCapacity: 3, Occupancy: 2, RemainingSlots: 1, Version: 2}, cage)
+}
+
+func Test_Handler_Patch_Dino(t *testing.T) {
+
+	asserter := assert.New(t)
+
+	server := newTestServer()
+	defer server.Close()
+
+	patch := func(contentType string, body string) *http.Response {
+		req, err := http.NewRequest(http.MethodPatch, server.URL+"/v1/dinosaur/3", strings.NewReader(body))
+		asserter.NoError(err)
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("If-Match", "*")
+		resp, err := http.DefaultClient.Do(req)
+		asserter.NoError(err)
+		return resp
+	}
+
+	resp := patch("application/merge-patch+json", `{"dino_name": "Bartholomew"}`)
+	asserter.Equal(http.StatusOK, resp.StatusCode)
+	dino := Dinosaur{}
+	asserter.NoError(json.NewDecoder(resp.Body).Decode(&dino))
+	resp.Body.Close()
+	asserter.Equal(Dinosaur{Id: 3, CageId: 2, Name: "Bartholomew", Species: "Brachiosaurus", Version: 2}, dino)
+
+	resp = patch("application/merge-patch+json", `{"dino_species": "Velociraptor"}`)
+	errResp := ErrorResponse{}
+	asserter.NoError(json.NewDecoder(resp.Body).Decode(&errResp))
+	resp.Body.Close()
+	asserter.Equal(http.StatusBadRequest, resp.StatusCode)
+	asserter.Equal(CodeValidationFailed, errResp.Code)
+	asserter.Equal([]FieldError{{Field: "dino_species", Rule: "readonly"}}, errResp.Errors)
+
+	resp = patch("text/plain", `{"dino_name": "Bart"}`)
+	resp.Body.Close()
+	asserter.Equal(http.StatusUnsupportedMediaType, resp.StatusCode)
+}
+
+func Test_Handler_ETags(t *testing.T) {
+
+	asserter := assert.New(t)
+
+	server := newTestServer()
+	defer server.Close()
+
+	call := func(method string, path string, header string, etag string, body string) *http.Response {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		asserter.NoError(err)
+		req.Header.Set("Content-Type", "application/json")
+		if etag != "" {
+			req.Header.Set(header, etag)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		asserter.NoError(err)
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := call(http.MethodGet, "/v1/dinosaur/1", "", "", "")
+	asserter.Equal(http.StatusOK, resp.StatusCode)
+	asserter.Equal(`"1"`, resp.Header.Get("ETag"))
+	resp = call(http.MethodGet, "/v1/dinosaur/1", "If-None-Match", `W/"1"`, "")
+	asserter.Equal(http.StatusNotModified, resp.StatusCode)
+	asserter.Equal(`"1"`, resp.Header.Get("ETag"))
+
+	rename := `{"cage_id": 1, "dino_name": "Maggie II", "dino_species": "Tyrannosaurus"}`
+	asserter.Equal(http.StatusPreconditionRequired, call(http.MethodPut, "/v1/dinosaur/1", "", "", rename).StatusCode)
+	resp = call(http.MethodPut, "/v1/dinosaur/1", "If-Match", `"1"`, rename)
+	asserter.Equal(http.StatusOK, resp.StatusCode)
+	asserter.Equal(`"2"`, resp.Header.Get("ETag"))
+	// the first write won, the second was made against what it replaced
+	asserter.Equal(http.StatusPreconditionFailed, call(http.MethodPut, "/v1/dinosaur/1", "If-Match", `"1"`, rename).StatusCode)
+	asserter.Equal(http.StatusPreconditionFailed, call(http.MethodDelete, "/v1/dinosaur/1", "If-Match", `"1"`, "").StatusCode)
+	asserter.Equal(http.StatusOK, call(http.MethodGet, "/v1/dinosaur/1", "If-None-Match", `"1"`, "").StatusCode)
+
+	// a cage changes when a dino moves in, not only when it is updated
+	resp = call(http.MethodGet, "/v1/cage/2", "", "", "")
+	asserter.Equal(`"1-3"`, resp.Header.Get("ETag"))
+	cera := `{"cage_id": 2, "dino_name": "Cera", "dino_species": "Triceratops"}`
+	asserter.Equal(http.StatusCreated, call(http.MethodPost, "/v1/dinosaur", "", "", cera).StatusCode)
+	asserter.Equal(http.StatusOK, call(http.MethodGet, "/v1/cage/2", "If-None-Match", `"1-3"`, "").StatusCode)
+	grow := `{"max_capacity": 10}`
+	asserter.Equal(http.StatusPreconditionFailed, call(http.MethodPatch, "/v1/cage/2", "If-Match", `"1-3"`, grow).StatusCode)
+	asserter.Equal(http.StatusOK, call(http.MethodPatch, "/v1/cage/2", "If-Match", `"1-4"`, grow).StatusCode)
+	asserter.Equal(http.StatusNotModified, call(http.MethodGet, "/v1/cage/2", "If-None-Match", `"1-4", "2-4"`, "").StatusCode)
+
+	// a dino moving out changes the tag too, but moves leave the version as it is
+	asserter.Equal(http.StatusCreated, call(http.MethodPost, "/v1/cage", "", "", `{"cage_name": "Cage Three", "cage_status": "ACTIVE", "max_capacity": 2}`).StatusCode)
+	asserter.Equal(http.StatusOK, call(http.MethodPatch, "/v1/dinosaur/3", "If-Match", "*", `{"cage_id": 3}`).StatusCode)
+	asserter.Equal(http.StatusPreconditionFailed, call(http.MethodPatch, "/v1/cage/2", "If-Match", `"2-4"`, grow).StatusCode)
+	asserter.Equal(http.StatusOK, call(http.MethodPatch, "/v1/cage/2", "If-Match", `"2-3"`, grow).StatusCode)
+}
+
+func Test_Handler_Idempotency_Keys(t *testing.T) {
+
+	asserter := assert.New(t)
+
+	server := newTestServer()
+	defer server.Close()
+
+	post := func(key string, body string) (*http.Response, string) {
+		req, err := http.NewRequest(http.MethodPost, server.URL+"/v1/dinosaur", strings.NewReader(body))
+		asserter.NoError(err)
+		req.Header.Set("Idempotency-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		asserter.NoError(err)
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		asserter.NoError(err)
+		return resp, string(data)
+	}
+	countDinos := func() int {
+		resp, err := http.Get(server.URL + "/v1/dinosaurs?cage_id=2")
+		asserter.NoError(err)
+		defer resp.Body.Close()
+		page := Page[Dinosaur]{}
+		asserter.NoError(json.NewDecoder(resp.Body).Decode(&page))
+		return len(page.Items)
+	}
+
+	cera := `{"cage_id": 2, "dino_name": "Cera", "dino_species": "Triceratops"}`
+	first, created := post("tablet-7-0001", cera)
+	asserter.Equal(http.StatusCreated, first.StatusCode)
+	asserter.Empty(first.Header.Get("Idempotent-Replayed"))
+
+	// the tablet never saw the response and sends it again
+	retry, replayed := post("tablet-7-0001", cera)
+	asserter.Equal(http.StatusCreated, retry.StatusCode)
+	asserter.Equal("true", retry.Header.Get("Idempotent-Replayed"))
+	asserter.Equal(created, replayed)
+	asserter.Equal(first.Header.Get("Location"), retry.Header.Get("Location"))
+	asserter.Equal(first.Header.Get("Content-Type"), retry.Header.Get("Content-Type"))
+	asserter.Equal(4, countDinos())
+
+	reused, body := post("tablet-7-0001", `{"cage_id": 2, "dino_name": "Littlefoot", "dino_species": "Brachiosaurus"}`)
+	asserter.Equal(http.StatusConflict, reused.StatusCode)
+	asserter.Contains(body, string(CodeIdempotencyKeyReused))
+
+	// refusals are replayed as well, the request is not tried again
+	refused := `{"cage_id": 1, "dino_name": "Cera", "dino_species": "Triceratops"}`
+	resp, _ := post("tablet-7-0002", refused)
+	asserter.Equal(http.StatusBadRequest, resp.StatusCode)
+	resp, _ = post("tablet-7-0002", refused)
+	asserter.Equal(http.StatusBadRequest, resp.StatusCode)
+	asserter.Equal("true", resp.Header.Get("Idempotent-Replayed"))
+	asserter.Equal("application/problem+json", resp.Header.Get("Content-Type"))
+	asserter.Equal(4, countDinos())
+
+	// a dry run and the real evacuation are different requests, the key cannot be used for both
+	roomy := `{"cage_name": "Cage Three", "cage_status": "ACTIVE", "max_capacity": 10}`
+	resp, err := http.Post(server.URL+"/v1/cage", "application/json", strings.NewReader(roomy))
+	asserter.NoError(err)
+	resp.Body.Close()
+	asserter.Equal(http.StatusCreated, resp.StatusCode)
+	evacuate := func(query string) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, server.URL+"/v1/cage/2/evacuate"+query, nil)
+		asserter.NoError(err)
+		req.Header.Set("Idempotency-Key", "tablet-7-0003")
+		resp, err := http.DefaultClient.Do(req)
+		asserter.NoError(err)
+		resp.Body.Close()
+		return resp
+	}
+	asserter.Equal(http.StatusOK, evacuate("?dry_run=true").StatusCode)
+	resp = evacuate("")
+	asserter.Equal(http.StatusConflict, resp.StatusCode)
+	asserter.Empty(resp.Header.Get("Idempotent-Replayed"))
+	asserter.Equal(4, countDinos())
+}
+
+func Test_Handler_Event_Stream(t *testing.T) {
+
+	asserter := assert.New(t)
+
+	server := newTestServer()
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	subscribe := func(lastEventId string) (*http.Response, *bufio.Reader) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/v1/events", nil)
+		asserter.NoError(err)
+		if lastEventId != "" {
+			req.Header.Set("Last-Event-ID", lastEventId)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		asserter.NoError(err)
+		return resp, bufio.NewReader(resp.Body)
+	}
+	// next reads the id and type of the next event, skipping comments
+	next := func(stream *bufio.Reader) (string, string) {
+		id, eventType := "", ""
+		for {
+			line, err := stream.ReadString('\n')
+			asserter.NoError(err)
+			line = strings.TrimSuffix(line, "\n")
+			switch {
+			case line == "" && id != "":
+				return id, eventType
+			case strings.HasPrefix(line, "id: "):
+				id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				eventType = strings.TrimPrefix(line, "event: ")
+			}
+		}
+	}
+	post := func(path string, body string) {
+		resp, err := http.Post(server.URL+path, "application/json", strings.NewReader(body))
+		asserter.NoError(err)
+		resp.Body.Close()
+		asserter.Equal(http.StatusCreated, resp.StatusCode)
+	}
+
+	post("/v1/cage", `{"cage_name": "Cage Three", "cage_status": "ACTIVE", "max_capacity": 4}`)
+
+	// resuming from the start replays the log, then follows it
+	resp, resumed := subscribe("0")
+	defer resp.Body.Close()
+	asserter.Equal(http.StatusOK, resp.StatusCode)
+	asserter.Equal("text/event-stream", resp.Header.Get("Content-Type"))
+	id, eventType := next(resumed)
+	asserter.Equal("1", id)
+	asserter.Equal(EventCageCreated, eventType)
+
+	// a new stream only sees what happens next
+	live, fresh := subscribe("")
+	defer live.Body.Close()
+	post("/v1/dinosaur", `{"cage_id": 3, "dino_name": "Cera", "dino_species": "Triceratops"}`)
+	for _, stream := range []*bufio.Reader{resumed, fresh} {
+		id, eventType = next(stream)
+		asserter.Equal("2", id)
+		asserter.Equal(EventDinosaurAdded, eventType)
+	}
+
+	bad, _ := subscribe("not-an-id")
+	bad.Body.Close()
+	asserter.Equal(http.StatusBadRequest, bad.StatusCode)
+}
+
+func Test_Handler_Audit(t *testing.T) {
+
+	asserter := assert.New(t)
+
+	server := newTestServer()
+	defer server.Close()
+
+	body := `{"cage_name": "test_cage", "cage_status": "ACTIVE", "max_capacity": 2}`
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/v1/cage", strings.NewReader(body))
+	asserter.NoError(err)
+	req.Header.Set("X-Actor", "arnold")
+	resp, err := http.DefaultClient.Do(req)
+	asserter.NoError(err)
+	resp.Body.Close()
+	asserter.Equal(http.StatusCreated, resp.StatusCode)
+
+	resp, err = http.Get(server.URL + "/v1/audit?entity=cage&id=3&from=2000-01-01T00:00:00Z")
+	asserter.NoError(err)
+	defer resp.Body.Close()
+	asserter.Equal(http.StatusOK, resp.StatusCode)
+	events := Page[AuditEvent]{}
+	asserter.NoError(json.NewDecoder(resp.Body).Decode(&events))
+	asserter.Len(events.Items, 1)
+	asserter.Equal("arnold", events.Items[0].Actor)
+	asserter.Equal(AuditCreate, events.Items[0].Action)
+
+	resp, err = http.Get(server.URL + "/v1/audit?from=yesterday")
+	asserter.NoError(err)
+	resp.Body.Close()
+	asserter.Equal(http.StatusBadRequest, resp.StatusCode)
+}
+
+func Test_Handler_Roles(t *testing.T) {
+
+	asserter := assert.New(t)
+
+	secret := []byte("test-secret")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	asserter.NoError(err)
+	auth, err := NewJWTAuthenticator(JWTConfig{HS256Secret: secret, RS256PublicKey: &rsaKey.PublicKey})
+	asserter.NoError(err)
+	logger := zerolog.Nop()
+	dinoService := NewDinoService(getClient())
+	server := httptest.NewServer(NewHandler(dinoService, dinoService, dinoService, &logger, auth))
+	defer server.Close()
+
+	hs256 := func(subject string, role Role, expires time.Time) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwtClaims{
+			Role:             role,
+			RegisteredClaims: jwt.RegisteredClaims{Subject: subject, ExpiresAt: jwt.NewNumericDate(expires)},
+		}).SignedString(secret)
+		asserter.NoError(err)
+		return token
+	}
+	later := time.Now().Add(time.Hour)
+	viewer := hs256("nedry", RoleViewer, later)
+	keeper := hs256("muldoon", RoleKeeper, later)
+	rs256Admin, err := jwt.NewWithClaims(jwt.SigningMethodRS256, jwtClaims{
+		Role:             RoleAdmin,
+		RegisteredClaims: jwt.RegisteredClaims{Subject: "hammond", ExpiresAt: jwt.NewNumericDate(later)},
+	}).SignedString(rsaKey)
+	asserter.NoError(err)
+
+	call := func(method string, path string, token string, body string) *http.Response {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		asserter.NoError(err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		req.Header.Set("If-Match", "*")
+		resp, err := http.DefaultClient.Do(req)
+		asserter.NoError(err)
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := call(http.MethodGet, "/v1/cages", "", "")
+	asserter.Equal(http.StatusUnauthorized, resp.StatusCode)
+	asserter.Equal(`Bearer realm="jp"`, resp.Header.Get("WWW-Authenticate"))
+	asserter.Equal(http.StatusUnauthorized, call(http.MethodGet, "/v1/cages", "not-a-token", "").StatusCode)
+	asserter.Equal(http.StatusUnauthorized, call(http.MethodGet, "/v1/cages", hs256("nedry", RoleViewer, time.Now().Add(-time.Minute)), "").StatusCode)
+	asserter.Equal(http.StatusUnauthorized, call(http.MethodGet, "/v1/cages", hs256("nedry", "janitor", later), "").StatusCode)
+
+	asserter.Equal(http.StatusOK, call(http.MethodGet, "/v1/cages", viewer, "").StatusCode)
+	move := `{"cage_id": 1, "dino_name": "Maggie", "dino_species": "Tyrannosaurus"}`
+	asserter.Equal(http.StatusForbidden, call(http.MethodPut, "/v1/dinosaur/1", viewer, move).StatusCode)
+	asserter.Equal(http.StatusOK, call(http.MethodPut, "/v1/dinosaur/1", keeper, move).StatusCode)
+
+	cage := `{"cage_name": "test_cage", "cage_status": "ACTIVE", "max_capacity": 2}`
+	asserter.Equal(http.StatusForbidden, call(http.MethodPost, "/v1/cage", keeper, cage).StatusCode)
+	asserter.Equal(http.StatusCreated, call(http.MethodPost, "/v1/cage", rs256Admin, cage).StatusCode)
+
+	// the subject of the token is the actor in the audit log
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/v1/audit?entity=cage", nil)
+	asserter.NoError(err)
+	req.Header.Set("Authorization", "Bearer "+viewer)
+	auditResp, err := http.DefaultClient.Do(req)
+	asserter.NoError(err)
+	defer auditResp.Body.Close()
+	events := Page[AuditEvent]{}
+	asserter.NoError(json.NewDecoder(auditResp.Body).Decode(&events))
+	asserter.Len(events.Items, 1)
+	asserter.Equal("hammond", events.Items[0].Actor)
+}
+
+func Test_Handler_Error_Codes(t *testing.T) {
+
+	asserter := assert.New(t)
+
+	server := newTestServer()
+	defer server.Close()
+
+	problem := func(resp *http.Response) ErrorResponse {
+		defer resp.Body.Close()
+		asserter.Equal("application/problem+json", resp.Header.Get("Content-Type"))
+		errResp := ErrorResponse{}
+		asserter.NoError(json.NewDecoder(resp.Body).Decode(&errResp))
+		asserter.Equal(resp.StatusCode, errResp.Status)
+		return errResp
+	}
+
+	body := `{"cage_id": 1, "dino_name": "", "dino_species": "Tyrannosaurus"}`
+	resp, err := http.Post(server.URL+"/v1/dinosaur", "application/json", strings.NewReader(body))
+	asserter.NoError(err)
+	errResp := problem(resp)
+	asserter.Equal(CodeValidationFailed, errResp.Code)
+	asserter.Equal([]FieldError{{Field: "dino_name", Rule: "required"}}, errResp.Errors)
+
+	body = `{"moves": [{"dino_id": 1, "target_cage_id": 0}]}`
+	resp, err = http.Post(server.URL+"/v1/relocations", "application/json", strings.NewReader(body))
+	asserter.NoError(err)
+	errResp = problem(resp)
+	asserter.Equal(CodeValidationFailed, errResp.Code)
+	asserter.Equal([]FieldError{{Field: "moves[0].target_cage_id", Rule: "required"}}, errResp.Errors)
+
+	// Cage One holds two Tyrannosaurus, so it cannot be made smaller than that
+	body = `{"cage_name": "Cage One", "cage_status": "ACTIVE", "max_capacity": 1}`
+	req, err := http.NewRequest(http.MethodPut, server.URL+"/v1/cage/1", strings.NewReader(body))
+	asserter.NoError(err)
+	req.Header.Set("If-Match", `"1-2"`)
+	resp, err = http.DefaultClient.Do(req)
+	asserter.NoError(err)
+	asserter.Equal(CodeCapacityExceeded, problem(resp).Code)
+
+	resp, err = http.Get(server.URL + "/v1/dinosaur/99")
+	asserter.NoError(err)
+	errResp = problem(resp)
+	asserter.Equal(CodeNotFound, errResp.Code)
+	asserter.Equal("Not Found", errResp.Title)
+	asserter.NotEmpty(errResp.Detail)
+
+	resp, err = http.Get(server.URL + "/v1/cages?cursor=nonsense")
+	asserter.NoError(err)
+	asserter.Equal(CodeValidationFailed, problem(resp).Code)
+
+	// a bad id in the path is the same 400 on every endpoint
+	for _, path := range []string{"/v1/dinosaurs/cage/one", "/v1/dinosaur/one", "/v1/cage/one"} {
+		resp, err = http.Get(server.URL + path)
+		asserter.NoError(err)
+		errResp = problem(resp)
+		asserter.Equal(http.StatusBadRequest, errResp.Status, path)
+		asserter.Equal(CodeBadRequest, errResp.Code, path)
+	}
+}
+
+func Test_Handler_Missing_and_Conflicting_Records(t *testing.T) {
+
+	asserter := assert.New(t)
+
+	server := newTestServer()
+	defer server.Close()
+
+	call := func(method string, path string, body string) ErrorResponse {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		asserter.NoError(err)
+		req.Header.Set("If-Match", "*")
+		resp, err := http.DefaultClient.Do(req)
+		asserter.NoError(err)
+		defer resp.Body.Close()
+		errResp := ErrorResponse{}
+		if resp.StatusCode >= http.StatusBadRequest {
+			asserter.NoError(json.NewDecoder(resp.Body).Decode(&errResp))
+		}
+		errResp.Status = resp.StatusCode
+		return errResp
+	}
+
+	cage := `{"cage_name": "Cage Nine", "cage_status": "ACTIVE", "max_capacity": 2}`
+	asserter.Equal(http.StatusNotFound, call(http.MethodPut, "/v1/cage/9999", cage).Status)
+	asserter.Equal(http.StatusNotFound, call(http.MethodPut, "/v1/dinosaur/9999", `{"cage_id": 1, "dino_name": "Rex", "dino_species": "Tyrannosaurus"}`).Status)
+	asserter.Equal(http.StatusNotFound, call(http.MethodPut, "/v1/species/Dilophosaurus", `{"diet": "carnivore"}`).Status)
+	asserter.Equal(http.StatusNotFound, call(http.MethodDelete, "/v1/species/Dilophosaurus", "").Status)
+	asserter.Equal(http.StatusNotFound, call(http.MethodDelete, "/v1/cage/9999", "").Status)
+
+	taken := `{"cage_name": "Cage One", "cage_status": "ACTIVE", "max_capacity": 2}`
+	errResp := call(http.MethodPost, "/v1/cage", taken)
+	asserter.Equal(http.StatusConflict, errResp.Status)
+	asserter.Equal(CodeConflict, errResp.Code)
+	asserter.Equal("There is already a cage named Cage One", errResp.Detail)
+	asserter.Equal(http.StatusConflict, call(http.MethodPut, "/v1/cage/2", `{"cage_name": "Cage One", "cage_status": "ACTIVE", "max_capacity": 6}`).Status)
+	asserter.Equal(http.StatusConflict, call(http.MethodPost, "/v1/species", `{"name": "Velociraptor", "diet": "carnivore"}`).Status)
+
+	errResp = call(http.MethodDelete, "/v1/cage/1", "")
+	asserter.Equal(http.StatusConflict, errResp.Status)
+	asserter.Equal(CodeCageNotEmpty, errResp.Code)
+
+	errResp = call(http.MethodPost, "/v1/dinosaur", `{"cage_id": 9999, "dino_name": "Rex", "dino_species": "Tyrannosaurus"}`)
+	asserter.Equal(http.StatusUnprocessableEntity, errResp.Status)
+	asserter.Equal(CodeCageNotFound, errResp.Code)
+	errResp = call(http.MethodPost, "/v1/dinosaur", `{"cage_id": 1, "dino_name": "Rex", "dino_species": "Dilophosaurus"}`)
+	asserter.Equal(http.StatusUnprocessableEntity, errResp.Status)
+	asserter.Equal(CodeUnknownSpecies, errResp.Code)
+}
+
+func Test_Handler_Delete_Archive(t *testing.T) {
+
+	asserter := assert.New(t)
+
+	server := newTestServer()
+	defer server.Close()
+
+	call := func(method string, path string) int {
+		req, err := http.NewRequest(method, server.URL+path, nil)
+		asserter.NoError(err)
+		req.Header.Set("If-Match", "*")
+		resp, err := http.DefaultClient.Do(req)
+		asserter.NoError(err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// an archive flag that cannot be read is refused, it is never taken as a hard delete
+	asserter.Equal(http.StatusBadRequest, call(http.MethodDelete, "/v1/dinosaur/3?archive=yes"))
+	asserter.Equal(http.StatusOK, call(http.MethodGet, "/v1/dinosaur/3"))
+	asserter.Equal(http.StatusNoContent, call(http.MethodDelete, "/v1/dinosaur/3?archive=true"))
+	asserter.Equal(http.StatusNotFound, call(http.MethodGet, "/v1/dinosaur/3"))
+
+	resp, err := http.Post(server.URL+"/v1/cage", "application/json", strings.NewReader(`{"cage_name": "Cage Three", "cage_status": "ACTIVE", "max_capacity": 2}`))
+	asserter.NoError(err)
+	resp.Body.Close()
+	asserter.Equal(http.StatusCreated, resp.StatusCode)
+	asserter.Equal(http.StatusBadRequest, call(http.MethodDelete, "/v1/cage/3?archive=ture"))
+	asserter.Equal(http.StatusOK, call(http.MethodGet, "/v1/cage/3"))
+}
+
+func newTestServer() *httptest.Server {
+	logger := zerolog.Nop()
+	dinoService := NewDinoService(getClient())
+	return httptest.NewServer(NewHandler(dinoService, dinoService, dinoService, &logger, OpenAccess{}))
+}
+
+func Test_Handler_API_Keys(t *testing.T) {
+
+	asserter := assert.New(t)
+
+	secret := []byte("test-secret")
+	jwtAuth, err := NewJWTAuthenticator(JWTConfig{HS256Secret: secret})
+	asserter.NoError(err)
+	dinoService := NewDinoService(getClient())
+	logger := zerolog.Nop()
+	server := httptest.NewServer(NewHandler(dinoService, dinoService, dinoService, &logger, NewAPIKeyAuthenticator(dinoService, jwtAuth)))
+	defer server.Close()
+
+	bearer := func(role Role) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwtClaims{
+			Role:             role,
+			RegisteredClaims: jwt.RegisteredClaims{Subject: "hammond", ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))},
+		}).SignedString(secret)
+		asserter.NoError(err)
+		return "Bearer " + token
+	}
+	admin := bearer(RoleAdmin)
+
+	call := func(method string, path string, header string, value string, body string) *http.Response {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		asserter.NoError(err)
+		req.Header.Set(header, value)
+		resp, err := http.DefaultClient.Do(req)
+		asserter.NoError(err)
+		return resp
+	}
+
+	// only admins manage keys
+	resp := call(http.MethodPost, "/v1/api-keys", "Authorization", bearer(RoleKeeper), `{"name": "fence monitor", "scopes": ["cages:read"]}`)
+	resp.Body.Close()
+	asserter.Equal(http.StatusForbidden, resp.StatusCode)
+	resp = call(http.MethodPost, "/v1/api-keys", "Authorization", admin, `{"name": "fence monitor", "scopes": ["fences:read"]}`)
+	resp.Body.Close()
+	asserter.Equal(http.StatusBadRequest, resp.StatusCode)
+
+	resp = call(http.MethodPost, "/v1/api-keys", "Authorization", admin, `{"name": "fence monitor", "scopes": ["cages:read"]}`)
+	asserter.Equal(http.StatusCreated, resp.StatusCode)
+	minted := MintedAPIKey{}
+	asserter.NoError(json.NewDecoder(resp.Body).Decode(&minted))
+	resp.Body.Close()
+	asserter.True(strings.HasPrefix(minted.Key, minted.Prefix))
+	asserter.Nil(minted.LastUsedAt)
+
+	// the key can do what its scopes allow and nothing else
+	resp = call(http.MethodGet, "/v1/cages", "X-API-Key", minted.Key, "")
+	resp.Body.Close()
+	asserter.Equal(http.StatusOK, resp.StatusCode)
+	resp = call(http.MethodGet, "/v1/dinosaurs", "X-API-Key", minted.Key, "")
+	resp.Body.Close()
+	asserter.Equal(http.StatusForbidden, resp.StatusCode)
+	resp = call(http.MethodGet, "/v1/api-keys", "X-API-Key", minted.Key, "")
+	resp.Body.Close()
+	asserter.Equal(http.StatusForbidden, resp.StatusCode)
+	resp = call(http.MethodGet, "/v1/cages", "X-API-Key", minted.Key+"x", "")
+	resp.Body.Close()
+	asserter.Equal(http.StatusUnauthorized, resp.StatusCode)
+
+	resp = call(http.MethodPut, "/v1/api-keys/"+strconv.FormatInt(minted.Id, 10), "Authorization", admin, `{"scopes": ["cages:read", "dinosaurs:read"]}`)
+	resp.Body.Close()
+	asserter.Equal(http.StatusOK, resp.StatusCode)
+	resp = call(http.MethodGet, "/v1/dinosaurs", "X-API-Key", minted.Key, "")
+	resp.Body.Close()
+	asserter.Equal(http.StatusOK, resp.StatusCode)
+
+	// the list shows when the key was last used but never the key or its hash
+	resp = call(http.MethodGet, "/v1/api-keys", "Authorization", admin, "")
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	asserter.NoError(err)
+	asserter.NotContains(string(body), minted.Key)
+	asserter.NotContains(string(body), hashAPIKey(minted.Key))
+	keys := Page[APIKey]{}
+	asserter.NoError(json.Unmarshal(body, &keys))
+	asserter.Len(keys.Items, 1)
+	asserter.Equal([]string{"cages:read", "dinosaurs:read"}, keys.Items[0].Scopes)
+	asserter.NotNil(keys.Items[0].LastUsedAt)
+
+	resp = call(http.MethodDelete, "/v1/api-keys/"+strconv.FormatInt(minted.Id, 10), "Authorization", admin, "")
+	resp.Body.Close()
+	asserter.Equal(http.StatusNoContent, resp.StatusCode)
+	resp = call(http.MethodGet, "/v1/cages", "X-API-Key", minted.Key, "")
+	resp.Body.Close()
+	asserter.Equal(http.StatusUnauthorized, resp.StatusCode)
+	resp = call(http.MethodDelete, "/v1/api-keys/99", "Authorization", admin, "")
+	resp.Body.Close()
+	asserter.Equal(http.StatusNotFound, resp.StatusCode)
+}
@@ -0,0 +1,50 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"jp/app/db"
+	"time"
+)
+
+type DinoPlacement = db.DinoPlacement
+
+// CageOccupancy lists the dinos that were in a cage at a given time
+type CageOccupancy struct {
+	CageId     int64           `json:"cage_id"`
+	At         time.Time       `json:"at"`
+	Placements []DinoPlacement `json:"placements"`
+}
+
+// GetDinoHistory get a page of the cages a dino has been in, oldest first
+func (s dinoServiceImpl) GetDinoHistory(ctx context.Context, dinoId int64, page PageRequest) (Page[DinoPlacement], error) {
+	afterId, err := validatePageRequest(page)
+	if err != nil {
+		return Page[DinoPlacement]{}, err
+	}
+	placements, err := s.dbService.Placements().ListByDino(ctx, dinoId, db.PlacementFilter{AfterId: afterId, Limit: page.limit() + 1})
+	if err != nil {
+		return Page[DinoPlacement]{}, err
+	}
+	// every dino has been placed somewhere, no history means no such dino
+	if len(placements) == 0 && afterId == 0 {
+		return Page[DinoPlacement]{Items: placements}, sql.ErrNoRows
+	}
+	return newPage(placements, page.limit(), func(p DinoPlacement) int64 { return p.Id }), nil
+}
+
+// GetCageOccupancy get the dinos that were in a cage at the given time
+func (s dinoServiceImpl) GetCageOccupancy(ctx context.Context, cageId int64, at time.Time) (CageOccupancy, error) {
+	placements, err := s.dbService.Placements().ListByCageAt(ctx, cageId, at)
+	if err != nil {
+		return CageOccupancy{}, err
+	}
+	// an empty cage still has to exist
+	if len(placements) == 0 {
+		_, err = s.dbService.Cages().Get(ctx, cageId)
+		if err != nil {
+			return CageOccupancy{}, err
+		}
+	}
+	return CageOccupancy{CageId: cageId, At: at, Placements: placements}, nil
+}
@@ -0,0 +1,258 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"jp/app/db"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/render"
+	"github.com/rs/zerolog"
+)
+
+type IdempotentRequest = db.IdempotentRequest
+
+const (
+	// DefaultIdempotencyTTL is how long a response is replayed to retries unless WithIdempotencyTTL says otherwise
+	DefaultIdempotencyTTL = 24 * time.Hour
+	// DefaultIdempotencyLease is how long a key is held for a request still being handled, unless WithIdempotencyLease
+	// says otherwise. A request the app never answered, because it stopped, frees its key once the lease runs out.
+	DefaultIdempotencyLease = time.Minute
+	// maxIdempotencyKeyLength keeps keys to something a client would generate, such as a UUID
+	maxIdempotencyKeyLength = 255
+	// maxIdempotencyAttempts bounds the tries at claiming a key that keeps being released or purged meanwhile
+	maxIdempotencyAttempts = 3
+)
+
+// IdempotencyStore keeps the responses to requests sent with an Idempotency-Key, so retries are answered
+// without the request being handled again
+type IdempotencyStore interface {
+	BeginIdempotentRequest(ctx context.Context, key string, fingerprint string) (*IdempotentRequest, error)
+	CompleteIdempotentRequest(ctx context.Context, key string, status int, header map[string]string, body []byte) error
+	ReleaseIdempotentRequest(ctx context.Context, key string) error
+	PurgeIdempotentRequests(ctx context.Context) (int64, error)
+}
+
+// replayedHeaders are the response headers kept with an idempotent request and sent again with its replays
+var replayedHeaders = []string{"Content-Type", "Location", "ETag"}
+
+// WithIdempotencyTTL return the DinoService keeping the responses to idempotent requests for ttl
+func (s dinoServiceImpl) WithIdempotencyTTL(ttl time.Duration) dinoServiceImpl {
+	s.idempotencyTTL = ttl
+	return s
+}
+
+// WithIdempotencyLease return the DinoService holding the key of an idempotent request being handled for lease,
+// it should be well above the time a request takes as a retry after it is handled again
+func (s dinoServiceImpl) WithIdempotencyLease(lease time.Duration) dinoServiceImpl {
+	s.idempotencyLease = lease
+	return s
+}
+
+// BeginIdempotentRequest claims an idempotency key for the caller. It returns nil when the request is new and
+// should be handled, or the stored request when it has already been answered and the response should be replayed.
+// A key still being handled or sent with a different request fails with a conflict.
+func (s dinoServiceImpl) BeginIdempotentRequest(ctx context.Context, key string, fingerprint string) (*IdempotentRequest, error) {
+	if key == "" || len(key) > maxIdempotencyKeyLength {
+		return nil, &ServiceRequestError{
+			err:      fmt.Sprintf("idempotency key of length %d", len(key)),
+			response: fmt.Sprintf("The Idempotency-Key must be between 1 and %d characters", maxIdempotencyKeyLength),
+			code:     CodeBadRequest,
+		}
+	}
+
+	for attempt := 0; attempt < maxIdempotencyAttempts; attempt++ {
+		now := time.Now().UTC()
+		request := IdempotentRequest{
+			Subject:     actorFrom(ctx),
+			Key:         key,
+			Fingerprint: fingerprint,
+			ExpiresAt:   now.Add(s.idempotencyLease),
+		}
+		err := s.dbService.Idempotency().Reserve(ctx, request, now)
+		if err == nil {
+			return nil, nil
+		}
+		if !errors.Is(err, db.ErrDuplicate) {
+			return nil, err
+		}
+
+		stored, err := s.dbService.Idempotency().Get(ctx, request.Subject, key, now)
+		if errors.Is(err, sql.ErrNoRows) {
+			// the request holding the key was released or expired meanwhile
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if stored.Fingerprint != fingerprint {
+			return nil, &ServiceRequestError{
+				err:      fmt.Sprintf("idempotency key %s reused", key),
+				response: "This Idempotency-Key was already used with a different request",
+				code:     CodeIdempotencyKeyReused,
+			}
+		}
+		if stored.Status == 0 {
+			return nil, keyInUse(key)
+		}
+		return &stored, nil
+	}
+	return nil, keyInUse(key)
+}
+
+// keyInUse is the error for a key held by another request
+func keyInUse(key string) error {
+	return &ServiceRequestError{
+		err:      fmt.Sprintf("idempotency key %s in use", key),
+		response: "A request with this Idempotency-Key is still being handled, retry later",
+		code:     CodeIdempotencyKeyInUse,
+	}
+}
+
+// CompleteIdempotentRequest stores the response to a request begun with BeginIdempotentRequest,
+// it is kept for the idempotency ttl from then on
+func (s dinoServiceImpl) CompleteIdempotentRequest(ctx context.Context, key string, status int, header map[string]string, body []byte) error {
+	return s.dbService.Idempotency().Complete(ctx, IdempotentRequest{
+		Subject:   actorFrom(ctx),
+		Key:       key,
+		Status:    status,
+		Header:    header,
+		Body:      body,
+		ExpiresAt: time.Now().UTC().Add(s.idempotencyTTL),
+	})
+}
+
+// ReleaseIdempotentRequest gives up the key of a request that was not answered, so a retry is handled afresh
+func (s dinoServiceImpl) ReleaseIdempotentRequest(ctx context.Context, key string) error {
+	err := s.dbService.Idempotency().Release(ctx, actorFrom(ctx), key)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	return err
+}
+
+// PurgeIdempotentRequests removes the requests that have expired, returning how many there were
+func (s dinoServiceImpl) PurgeIdempotentRequests(ctx context.Context) (int64, error) {
+	return s.dbService.Idempotency().DeleteExpired(ctx, time.Now().UTC())
+}
+
+// idempotent lets a client retry a POST safely with an Idempotency-Key header. The first response to a key
+// is stored and sent again to retries of the same request, a server error is not kept so it can be retried.
+// Requests without the header are handled as usual.
+func idempotent(store IdempotencyStore, logger *zerolog.Logger) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get("Idempotency-Key")
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				logger.Error().Err(err).Msg("error reading request data")
+				err := render.Render(w, r, BadRequest(err))
+				if err != nil {
+					logger.Error().Err(err).Msg("render error")
+				}
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			ctx := r.Context()
+			stored, err := store.BeginIdempotentRequest(ctx, key, requestFingerprint(r, body))
+			if err != nil {
+				logger.Error().Err(err).Str("idempotency_key", key).Msg("error beginning idempotent request")
+				err := render.Render(w, r, errorResponse(err))
+				if err != nil {
+					logger.Error().Err(err).Msg("render error")
+				}
+				return
+			}
+			if stored != nil {
+				for name, value := range stored.Header {
+					w.Header().Set(name, value)
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(stored.Status)
+				_, err := w.Write(stored.Body)
+				if err != nil {
+					logger.Error().Err(err).Msg("error replaying response")
+				}
+				return
+			}
+
+			recorder := &responseRecorder{ResponseWriter: w}
+			completed := false
+			// a handler that panics leaves no response to keep
+			defer func() {
+				if completed {
+					return
+				}
+				err := store.ReleaseIdempotentRequest(context.WithoutCancel(ctx), key)
+				if err != nil {
+					logger.Error().Err(err).Str("idempotency_key", key).Msg("error releasing idempotency key")
+				}
+			}()
+			next.ServeHTTP(recorder, r)
+			if recorder.status >= http.StatusInternalServerError {
+				return
+			}
+
+			status := recorder.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			header := map[string]string{}
+			for _, name := range replayedHeaders {
+				if value := recorder.Header().Get(name); value != "" {
+					header[name] = value
+				}
+			}
+			err = store.CompleteIdempotentRequest(context.WithoutCancel(ctx), key, status, header, recorder.body.Bytes())
+			if err != nil {
+				logger.Error().Err(err).Str("idempotency_key", key).Msg("error storing idempotent response")
+				return
+			}
+			completed = true
+		})
+	}
+}
+
+// requestFingerprint identifies a request by its method, path, query and body, a query such as
+// ?dry_run=true changes what the request does
+func requestFingerprint(r *http.Request, body []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(r.Method + " " + r.URL.Path + "?" + r.URL.RawQuery + "\n")) //nolint:errcheck
+	hash.Write(body)                                                              //nolint:errcheck
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// responseRecorder passes a response on while keeping a copy of its status and body
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(data []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(data)
+	return rec.ResponseWriter.Write(data)
+}
@@ -1,14 +1,28 @@
 package app
 
-type Dinosaur struct {
-	Id      int64  `json:"id"`
-	CageId  int64  `json:"cage_id" validate:"required"`
-	Name    string `json:"dino_name" validate:"required"`
-	Species string `json:"dino_species" validate:"oneof=Tyrannosaurus Velociraptor Spinosaurus Megalosaurus Brachiosaurus Stegosaurus Ankylosaurus Triceratops"`
-}
+import "jp/app/db"
+
+const (
+	CageStatusActive = "ACTIVE"
+	CageStatusDown   = "DOWN"
+)
+
+const (
+	DietCarnivore = "carnivore"
+	DietHerbivore = "herbivore"
+)
+
+type Dinosaur = db.Dinosaur
 
-type Cage struct {
-	Id     int64  `json:"id"`
-	Name   string `json:"cage_name" validate:"required"`
-	Status string `json:"cage_status" validate:"oneof=ACTIVE DOWN"`
+type Cage = db.Cage
+
+type Species = db.Species
+
+// DinoFilter holds the query parameters accepted by GET /dinosaurs
+type DinoFilter struct {
+	Species string `json:"species"`
+	Diet    string `json:"diet" validate:"omitempty,oneof=carnivore herbivore"`
+	CageId  int64  `json:"cage_id"`
 }
+
+type CageFilter = db.CageFilter
@@ -0,0 +1,62 @@
+package app
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+)
+
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 500
+)
+
+// PageRequest holds the ?limit= and ?cursor= query parameters of a list endpoint
+type PageRequest struct {
+	Limit  int    `json:"limit" validate:"omitempty,gt=0,lte=500"`
+	Cursor string `json:"cursor"`
+}
+
+// Page is the envelope every list endpoint responds with, next_cursor is empty on the last page
+type Page[T any] struct {
+	Items      []T    `json:"items"`
+	NextCursor string `json:"next_cursor"`
+}
+
+func (p PageRequest) limit() int {
+	if p.Limit == 0 {
+		return defaultPageLimit
+	}
+	return min(p.Limit, maxPageLimit)
+}
+
+// encodeCursor hides the keyset id so clients treat the cursor as opaque
+func encodeCursor(id int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(id, 10)))
+}
+
+func decodeCursor(cursor string) (int64, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, err
+	}
+	id, err := strconv.ParseInt(string(raw), 10, 64)
+	if err != nil || id <= 0 {
+		return 0, errors.New("invalid cursor")
+	}
+	return id, nil
+}
+
+// newPage trims items fetched with one extra row to the page size, the extra row
+// tells us there is another page which starts after the last id returned
+func newPage[T any](items []T, limit int, id func(T) int64) Page[T] {
+	page := Page[T]{Items: items}
+	if len(items) > limit {
+		page.Items = items[:limit]
+		page.NextCursor = encodeCursor(id(page.Items[limit-1]))
+	}
+	return page
+}
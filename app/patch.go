@@ -0,0 +1,202 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"jp/app/db"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// mergePatchContentType is the media type of a JSON merge patch
+const mergePatchContentType = "application/merge-patch+json"
+
+// PatchDino applies a JSON merge patch (RFC 7396) to a dino. Only the fields in the patch are validated
+// and the containment rules only run again when the patch moves the dino to another cage.
+func (s dinoServiceImpl) PatchDino(ctx context.Context, dinoId int64, patch json.RawMessage) (Dinosaur, error) {
+	catalogue, err := s.species.load(ctx, s.dbService.Species())
+	if err != nil {
+		return Dinosaur{}, err
+	}
+
+	var updated Dinosaur
+	err = s.inTx(ctx, func(repos db.Repositories) error {
+		current, err := repos.Dinos().GetForUpdate(ctx, dinoId)
+		if err != nil {
+			return err
+		}
+		err = checkIfMatch(ctx, dinoETag(current))
+		if err != nil {
+			return err
+		}
+		// the species of a dino never changes
+		dino, fields, err := mergePatch(current, patch, "id", "dino_species", "version")
+		if err != nil {
+			return err
+		}
+		err = newValidator().StructPartial(dino, fields...)
+		if err != nil {
+			return validationFailed(err)
+		}
+
+		if dino.CageId != current.CageId {
+			err = s.checkPlacement(ctx, repos, dino, current.CageId, catalogue, s.policy.Current())
+			if err != nil {
+				return err
+			}
+		}
+		updated, err = saveDino(ctx, repos, current, dino)
+		return err
+	})
+	if err != nil {
+		return Dinosaur{}, err
+	}
+	return updated, nil
+}
+
+// PatchCage applies a JSON merge patch (RFC 7396) to a cage, only the fields in the patch are validated
+func (s dinoServiceImpl) PatchCage(ctx context.Context, cageId int64, patch json.RawMessage) (Cage, error) {
+	var updated Cage
+	err := s.inTx(ctx, func(repos db.Repositories) error {
+		current, err := repos.Cages().GetForUpdate(ctx, cageId)
+		if err != nil {
+			return err
+		}
+		err = checkIfMatch(ctx, cageETag(current))
+		if err != nil {
+			return err
+		}
+		cage, fields, err := mergePatch(current, patch, "id", "occupancy", "remaining_slots", "version")
+		if err != nil {
+			return err
+		}
+		err = newValidator().StructPartial(cage, fields...)
+		if err != nil {
+			return validationFailed(err)
+		}
+		updated, err = saveCage(ctx, repos, current, cage)
+		return err
+	})
+	if err != nil {
+		return Cage{}, err
+	}
+	return updated, nil
+}
+
+// mergePatch applies a JSON merge patch to current and returns the result along with the Go names of the
+// fields the patch set, for StructPartial. The records patched here are flat so members are merged one level
+// deep, a null member resets the field to its zero value. Fields in readOnly may only be given their current value.
+func mergePatch[T any](current T, patch json.RawMessage, readOnly ...string) (T, []string, error) {
+	var merged T
+	members := map[string]json.RawMessage{}
+	err := json.Unmarshal(patch, &members)
+	if err != nil {
+		return merged, nil, &ServiceRequestError{
+			err:      err.Error(),
+			response: "The patch must be a JSON object. ",
+			code:     CodeBadRequest,
+		}
+	}
+
+	document := map[string]json.RawMessage{}
+	data, err := json.Marshal(current)
+	if err != nil {
+		return merged, nil, err
+	}
+	err = json.Unmarshal(data, &document)
+	if err != nil {
+		return merged, nil, err
+	}
+
+	goNames := jsonFieldNames(reflect.TypeOf(current))
+	fields := []string{}
+	failures := []FieldError{}
+	names := make([]string, 0, len(members))
+	for name := range members {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		value := members[name]
+		goName, ok := goNames[name]
+		if !ok {
+			failures = append(failures, FieldError{Field: name, Rule: "unknown"})
+			continue
+		}
+		if slices.Contains(readOnly, name) {
+			if !sameJSON(document[name], value) {
+				failures = append(failures, FieldError{Field: name, Rule: "readonly"})
+			}
+			continue
+		}
+		if bytes.Equal(bytes.TrimSpace(value), []byte("null")) {
+			delete(document, name)
+		} else {
+			document[name] = value
+		}
+		fields = append(fields, goName)
+	}
+	if len(failures) > 0 {
+		return merged, nil, patchFailed(failures)
+	}
+
+	data, err = json.Marshal(document)
+	if err != nil {
+		return merged, nil, err
+	}
+	err = json.Unmarshal(data, &merged)
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return merged, nil, patchFailed([]FieldError{{Field: typeErr.Field, Rule: "type", Param: typeErr.Type.String()}})
+	}
+	if err != nil {
+		return merged, nil, err
+	}
+	return merged, fields, nil
+}
+
+// jsonFieldNames maps the json name of each field of a struct type to its Go name
+func jsonFieldNames(typ reflect.Type) map[string]string {
+	names := map[string]string{}
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" || !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		names[name] = field.Name
+	}
+	return names
+}
+
+// sameJSON reports whether two JSON values are equal, regardless of formatting
+func sameJSON(a json.RawMessage, b json.RawMessage) bool {
+	var va, vb any
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return false
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+// patchFailed is the VALIDATION_FAILED error for patch members that cannot be applied
+func patchFailed(failures []FieldError) *ServiceRequestError {
+	var errString strings.Builder
+	names := make([]string, 0, len(failures))
+	for _, failure := range failures {
+		errString.WriteString(fmt.Sprintf("Invalid entry for %s. ", failure.Field))
+		names = append(names, failure.Field)
+	}
+	return &ServiceRequestError{
+		err:      fmt.Sprintf("patch cannot set %s", strings.Join(names, ", ")),
+		response: errString.String(),
+		code:     CodeValidationFailed,
+		fields:   failures,
+	}
+}
@@ -0,0 +1,105 @@
+package app
+
+import (
+	"context"
+	"sort"
+)
+
+// PlacementOption is one cage a dino could be put in, Violations says why a rejected cage would refuse it
+type PlacementOption struct {
+	Cage Cage `json:"cage"`
+	// SpeciesMatch is set when the cage already holds dinos of the same species
+	SpeciesMatch bool            `json:"species_match"`
+	Violations   []RuleViolation `json:"violations,omitempty"`
+}
+
+// PlacementOptions splits the cages into those that would accept a dino, best first, and those that would not
+type PlacementOptions struct {
+	Allowed  []PlacementOption `json:"allowed"`
+	Rejected []PlacementOption `json:"rejected"`
+}
+
+// GetPlacementOptions checks every cage against the containment rules for a new dino of the given species
+func (s dinoServiceImpl) GetPlacementOptions(ctx context.Context, species string) (PlacementOptions, error) {
+	catalogue, err := s.knownSpecies(ctx, species)
+	if err != nil {
+		return PlacementOptions{}, err
+	}
+	return s.placementOptions(ctx, Dinosaur{Species: species}, catalogue)
+}
+
+// GetDinoPlacementOptions checks every cage other than its own against the containment rules for moving a dino
+func (s dinoServiceImpl) GetDinoPlacementOptions(ctx context.Context, dinoId int64) (PlacementOptions, error) {
+	dino, err := s.dbService.Dinos().Get(ctx, dinoId)
+	if err != nil {
+		return PlacementOptions{}, err
+	}
+	catalogue, err := s.species.load(ctx, s.dbService.Species())
+	if err != nil {
+		return PlacementOptions{}, err
+	}
+	return s.placementOptions(ctx, dino, catalogue)
+}
+
+// placementOptions runs the rules against every cage without locking anything, so the answer is advice
+// and AddDino/UpdateDino still check the placement when it is made. The occupants are only read for the
+// cages that could take the dino, a DOWN or full cage refuses it whoever is inside, so a rejected cage of
+// that kind only lists the rules about the cage itself.
+func (s dinoServiceImpl) placementOptions(ctx context.Context, dino Dinosaur, catalogue map[string]Species) (PlacementOptions, error) {
+	cages, err := s.dbService.Cages().List(ctx, CageFilter{})
+	if err != nil {
+		return PlacementOptions{}, err
+	}
+
+	policy := s.policy.Current()
+	check := func(cage Cage, occupants []Dinosaur) []RuleViolation {
+		return s.rules.Check(Placement{
+			Dino:      dino,
+			From:      dino.CageId,
+			Cage:      cage,
+			Occupants: occupants,
+			Species:   catalogue,
+			Policy:    policy,
+		})
+	}
+	options := PlacementOptions{Allowed: []PlacementOption{}, Rejected: []PlacementOption{}}
+	for _, cage := range cages {
+		// a dino already in a cage is not offered it again
+		if dino.Id != 0 && cage.Id == dino.CageId {
+			continue
+		}
+		option := PlacementOption{Cage: cage}
+		if cage.Status != CageStatusActive || cage.RemainingSlots == 0 {
+			option.Violations = check(cage, nil)
+		}
+		// rules that do not look at the cage itself still need its occupants
+		if len(option.Violations) == 0 {
+			occupants, err := s.dbService.Dinos().ListByCage(ctx, cage.Id)
+			if err != nil {
+				return PlacementOptions{}, err
+			}
+			for _, occupant := range occupants {
+				if occupant.Species == dino.Species {
+					option.SpeciesMatch = true
+					break
+				}
+			}
+			option.Violations = check(cage, occupants)
+		}
+		if len(option.Violations) == 0 {
+			options.Allowed = append(options.Allowed, option)
+		} else {
+			options.Rejected = append(options.Rejected, option)
+		}
+	}
+
+	// cages already holding the species come first so herds stay together, then the emptiest cages
+	sort.SliceStable(options.Allowed, func(i, j int) bool {
+		a, b := options.Allowed[i], options.Allowed[j]
+		if a.SpeciesMatch != b.SpeciesMatch {
+			return a.SpeciesMatch
+		}
+		return a.Cage.RemainingSlots > b.Cage.RemainingSlots
+	})
+	return options, nil
+}
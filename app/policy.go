@@ -0,0 +1,282 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"gopkg.in/yaml.v3"
+)
+
+/*
+Policy is the compatibility policy the safety officers maintain in a YAML or JSON file:
+
+	allowed_pairs:
+	  - [Velociraptor, Spinosaurus]
+	max_group_size:
+	  Tyrannosaurus: 2
+	forbidden_pairs:
+	  - [Triceratops, Stegosaurus]
+
+- allowed_pairs may share a cage even when the diet rules would keep them apart
+- max_group_size caps how many dinos of a species can be in one cage
+- forbidden_pairs can never share a cage
+*/
+type Policy struct {
+	AllowedPairs   [][2]string
+	MaxGroupSize   map[string]int
+	ForbiddenPairs [][2]string
+}
+
+// Allows reports whether the policy lets the two species share a cage, a nil policy allows nothing
+func (p *Policy) Allows(a, b string) bool {
+	return p != nil && hasPair(p.AllowedPairs, a, b)
+}
+
+// Forbids reports whether the policy keeps the two species apart, a nil policy forbids nothing
+func (p *Policy) Forbids(a, b string) bool {
+	return p != nil && hasPair(p.ForbiddenPairs, a, b)
+}
+
+// GroupLimit returns the most dinos of a species one cage can hold, false when there is no limit
+func (p *Policy) GroupLimit(species string) (int, bool) {
+	if p == nil {
+		return 0, false
+	}
+	limit, ok := p.MaxGroupSize[species]
+	return limit, ok
+}
+
+func hasPair(pairs [][2]string, a, b string) bool {
+	for _, pair := range pairs {
+		if (pair[0] == a && pair[1] == b) || (pair[0] == b && pair[1] == a) {
+			return true
+		}
+	}
+	return false
+}
+
+// PolicyLineError is one problem found in a policy file
+type PolicyLineError struct {
+	Line    int
+	Message string
+}
+
+// PolicyError lists every problem found in a policy file, by line
+type PolicyError struct {
+	Path   string
+	Errors []PolicyLineError
+}
+
+func (e *PolicyError) Error() string {
+	lines := make([]string, 0, len(e.Errors))
+	for _, lineErr := range e.Errors {
+		lines = append(lines, fmt.Sprintf("%s:%d: %s", e.Path, lineErr.Line, lineErr.Message))
+	}
+	return "invalid policy file\n" + strings.Join(lines, "\n")
+}
+
+// LoadPolicy reads and validates a policy file, JSON being a subset of YAML both are accepted
+func LoadPolicy(path string, species map[string]Species) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePolicy(path, data, species)
+}
+
+// ParsePolicy validates a policy document, every problem is reported with its line rather than just the first.
+// The species it names must be in species, a misspelt name would otherwise make a rule that never applies.
+// A nil species skips that check.
+func ParsePolicy(path string, data []byte, species map[string]Species) (*Policy, error) {
+	var doc yaml.Node
+	err := yaml.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy file %s: %w", path, err)
+	}
+
+	policy := &Policy{MaxGroupSize: map[string]int{}}
+	parser := policyParser{species: species}
+	// an empty file is an empty policy
+	if len(doc.Content) == 0 {
+		return policy, nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		parser.fail(root, "the policy must be a mapping of allowed_pairs, max_group_size and forbidden_pairs")
+		return nil, &PolicyError{Path: path, Errors: parser.errors}
+	}
+
+	seen := map[string]bool{}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		if seen[key.Value] {
+			parser.fail(key, fmt.Sprintf("%s is given more than once", key.Value))
+			continue
+		}
+		seen[key.Value] = true
+
+		switch key.Value {
+		case "allowed_pairs":
+			policy.AllowedPairs = parser.pairs(key.Value, value)
+		case "forbidden_pairs":
+			policy.ForbiddenPairs = parser.pairs(key.Value, value)
+		case "max_group_size":
+			policy.MaxGroupSize = parser.groupSizes(value)
+		default:
+			parser.fail(key, fmt.Sprintf("unknown key %q, expected allowed_pairs, max_group_size or forbidden_pairs", key.Value))
+		}
+	}
+
+	// a pair cannot be both allowed and forbidden
+	for _, pair := range policy.ForbiddenPairs {
+		if hasPair(policy.AllowedPairs, pair[0], pair[1]) {
+			parser.errors = append(parser.errors, PolicyLineError{
+				Line:    parser.forbiddenLines[pairKey(pair)],
+				Message: fmt.Sprintf("%s and %s are both allowed and forbidden", pair[0], pair[1]),
+			})
+		}
+	}
+
+	if len(parser.errors) > 0 {
+		return nil, &PolicyError{Path: path, Errors: parser.errors}
+	}
+	return policy, nil
+}
+
+type policyParser struct {
+	errors []PolicyLineError
+	// species is the registry the names are checked against
+	species map[string]Species
+	// forbiddenLines remembers where each forbidden pair was given, for the conflict check
+	forbiddenLines map[string]int
+}
+
+func (p *policyParser) fail(node *yaml.Node, message string) {
+	p.errors = append(p.errors, PolicyLineError{Line: node.Line, Message: message})
+}
+
+func (p *policyParser) pairs(key string, node *yaml.Node) [][2]string {
+	if node.Kind != yaml.SequenceNode {
+		p.fail(node, fmt.Sprintf("%s must be a list of species pairs", key))
+		return nil
+	}
+	pairs := [][2]string{}
+	for _, item := range node.Content {
+		if item.Kind != yaml.SequenceNode || len(item.Content) != 2 {
+			p.fail(item, "a species pair must be a list of exactly two species names")
+			continue
+		}
+		a, b := item.Content[0], item.Content[1]
+		if !p.speciesName(a) || !p.speciesName(b) {
+			continue
+		}
+		if a.Value == b.Value {
+			p.fail(item, fmt.Sprintf("a species pair needs two different species, got %s twice", a.Value))
+			continue
+		}
+		pair := [2]string{a.Value, b.Value}
+		if key == "forbidden_pairs" {
+			if p.forbiddenLines == nil {
+				p.forbiddenLines = map[string]int{}
+			}
+			p.forbiddenLines[pairKey(pair)] = item.Line
+		}
+		pairs = append(pairs, pair)
+	}
+	return pairs
+}
+
+func (p *policyParser) groupSizes(node *yaml.Node) map[string]int {
+	sizes := map[string]int{}
+	if node.Kind != yaml.MappingNode {
+		p.fail(node, "max_group_size must map species names to a number of dinos")
+		return sizes
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if !p.speciesName(key) {
+			continue
+		}
+		if _, ok := sizes[key.Value]; ok {
+			p.fail(key, fmt.Sprintf("max_group_size for %s is given more than once", key.Value))
+			continue
+		}
+		size, err := strconv.Atoi(value.Value)
+		if value.Kind != yaml.ScalarNode || err != nil || size <= 0 {
+			p.fail(value, fmt.Sprintf("max_group_size for %s must be a whole number above 0", key.Value))
+			continue
+		}
+		sizes[key.Value] = size
+	}
+	return sizes
+}
+
+func (p *policyParser) speciesName(node *yaml.Node) bool {
+	if node.Kind != yaml.ScalarNode || node.Tag != "!!str" || strings.TrimSpace(node.Value) == "" {
+		p.fail(node, "a species must be given by its name")
+		return false
+	}
+	if _, ok := p.species[node.Value]; p.species != nil && !ok {
+		p.fail(node, fmt.Sprintf("unknown species %s", node.Value))
+		return false
+	}
+	return true
+}
+
+// pairKey is the same for a pair in either order
+func pairKey(pair [2]string) string {
+	if pair[0] > pair[1] {
+		return pair[1] + "\x00" + pair[0]
+	}
+	return pair[0] + "\x00" + pair[1]
+}
+
+// SpeciesCatalogue is the species registry a policy is checked against
+type SpeciesCatalogue interface {
+	SpeciesCatalogue(ctx context.Context) (map[string]Species, error)
+}
+
+// PolicyStore holds the policy in force, it can be swapped while requests are being served
+type PolicyStore struct {
+	path    string
+	species SpeciesCatalogue
+	current atomic.Pointer[Policy]
+}
+
+// NewPolicyStore loads the policy file at path, an invalid file or one naming a species
+// that is not in the catalogue is an error
+func NewPolicyStore(ctx context.Context, path string, species SpeciesCatalogue) (*PolicyStore, error) {
+	store := &PolicyStore{path: path, species: species}
+	err := store.Reload(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Reload reads the policy file again and checks it against the species registry as it stands now,
+// the policy in force is kept if the file is invalid
+func (s *PolicyStore) Reload(ctx context.Context) error {
+	catalogue, err := s.species.SpeciesCatalogue(ctx)
+	if err != nil {
+		return err
+	}
+	policy, err := LoadPolicy(s.path, catalogue)
+	if err != nil {
+		return err
+	}
+	s.current.Store(policy)
+	return nil
+}
+
+// Current returns the policy in force, nil when there is none
+func (s *PolicyStore) Current() *Policy {
+	if s == nil {
+		return nil
+	}
+	return s.current.Load()
+}
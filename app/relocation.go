@@ -0,0 +1,101 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"jp/app/db"
+)
+
+// Relocation moves one dino into another cage
+type Relocation struct {
+	DinoId       int64 `json:"dino_id" validate:"required"`
+	TargetCageId int64 `json:"target_cage_id" validate:"required"`
+}
+
+// RelocationPlan is a list of moves made in order, either all of them happen or none do
+type RelocationPlan struct {
+	Moves []Relocation `json:"moves" validate:"required,min=1,max=500,dive"`
+}
+
+// RelocationFailure says why one move of a plan was refused, Move is its index in the plan
+type RelocationFailure struct {
+	Move         int             `json:"move"`
+	DinoId       int64           `json:"dino_id"`
+	TargetCageId int64           `json:"target_cage_id"`
+	Code         ErrorCode       `json:"code"`
+	Reason       string          `json:"reason"`
+	Violations   []RuleViolation `json:"violations,omitempty"`
+}
+
+// RelocateDinos makes every move of the plan in a single transaction. Each move is checked against the
+// containment rules as the cages stand after the moves before it, so a herd can be swapped between full cages.
+// If any move is refused nothing is moved and every refused move is reported.
+func (s dinoServiceImpl) RelocateDinos(ctx context.Context, plan RelocationPlan) error {
+
+	v := newValidator()
+	err := v.Struct(plan)
+	if err != nil {
+		return validationFailed(err)
+	}
+
+	catalogue, err := s.species.load(ctx, s.dbService.Species())
+	if err != nil {
+		return err
+	}
+
+	// every move is checked against the same policy even if it is reloaded meanwhile
+	policy := s.policy.Current()
+	return s.inTx(ctx, func(repos db.Repositories) error {
+		failures := []RelocationFailure{}
+		for i, move := range plan.Moves {
+			err := s.relocateDino(ctx, repos, move, catalogue, policy)
+			if err == nil {
+				continue
+			}
+			// a refused move is left out and the rest of the plan is still checked,
+			// so every problem is reported at once
+			failure := RelocationFailure{Move: i, DinoId: move.DinoId, TargetCageId: move.TargetCageId}
+			var serviceErr *ServiceRequestError
+			if errors.Is(err, sql.ErrNoRows) {
+				failure.Code = CodeNotFound
+				failure.Reason = "The dinosaur does not exist"
+			} else if errors.As(err, &serviceErr) {
+				failure.Code = serviceErr.code
+				failure.Reason = serviceErr.response
+				failure.Violations = serviceErr.violations
+			} else {
+				return err
+			}
+			failures = append(failures, failure)
+		}
+
+		if len(failures) > 0 {
+			return &ServiceRequestError{
+				err:         fmt.Sprintf("%d of %d relocations refused", len(failures), len(plan.Moves)),
+				response:    "The relocation was refused, no dinosaur has been moved",
+				code:        CodeRelocationRefused,
+				relocations: failures,
+			}
+		}
+		return nil
+	})
+}
+
+// relocateDino makes one move of a plan, the dino and its target cage are locked like in updateDino
+func (s dinoServiceImpl) relocateDino(ctx context.Context, repos db.Repositories, move Relocation, catalogue map[string]Species, policy *Policy) error {
+	current, err := repos.Dinos().GetForUpdate(ctx, move.DinoId)
+	if err != nil {
+		return err
+	}
+	dino := current
+	dino.CageId = move.TargetCageId
+
+	err = s.checkPlacement(ctx, repos, dino, current.CageId, catalogue, policy)
+	if err != nil {
+		return err
+	}
+	_, err = saveDino(ctx, repos, current, dino)
+	return err
+}
@@ -0,0 +1,198 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Placement is a dino about to be put in a cage, it is what a ContainmentRule checks
+type Placement struct {
+	Dino Dinosaur
+	// From is the cage the dino is in now, 0 for a new dino
+	From int64
+	Cage Cage
+	// Occupants are the dinos already in the cage, never including Dino itself
+	Occupants []Dinosaur
+	// Species is the species catalogue by name
+	Species map[string]Species
+	// Policy is the compatibility policy in force, nil when there is none
+	Policy *Policy
+}
+
+// RuleViolation names the rule a placement broke and says why, Code is left empty by rules without one
+type RuleViolation struct {
+	Rule   string    `json:"rule"`
+	Code   ErrorCode `json:"code,omitempty"`
+	Reason string    `json:"reason"`
+}
+
+// ContainmentRule decides whether a placement is safe, returning nil when it is
+type ContainmentRule interface {
+	Name() string
+	Check(p Placement) *RuleViolation
+}
+
+// ContainmentRules run in order, every rule is checked so all the violations are reported together
+type ContainmentRules []ContainmentRule
+
+func (rules ContainmentRules) Check(p Placement) []RuleViolation {
+	violations := []RuleViolation{}
+	for _, rule := range rules {
+		violation := rule.Check(p)
+		if violation != nil {
+			violation.Rule = rule.Name()
+			violations = append(violations, *violation)
+		}
+	}
+	return violations
+}
+
+/*
+DefaultContainmentRules:
+- dinos cannot be put in a DOWN cage
+- a cage cannot hold more dinos than its max_capacity
+- herbivores cannot be in same cage as carnivores
+- carnivores can only be in same cage as same species
+- the policy file can allow species pairs the two rules above would keep apart,
+cap the group size of a species and forbid species pairs
+*/
+func DefaultContainmentRules() ContainmentRules {
+	return ContainmentRules{
+		CagePoweredRule{},
+		CageCapacityRule{},
+		DietSeparationRule{},
+		CarnivoreSpeciesRule{},
+		PolicyGroupSizeRule{},
+		PolicyForbiddenPairRule{},
+	}
+}
+
+type CagePoweredRule struct{}
+
+func (CagePoweredRule) Name() string {
+	return "cage_powered"
+}
+
+func (CagePoweredRule) Check(p Placement) *RuleViolation {
+	// a dino already in the cage is not being put there
+	if p.Cage.Status == CageStatusDown && p.From != p.Cage.Id {
+		return &RuleViolation{Code: CodeCagePoweredDown, Reason: "The cage is powered down"}
+	}
+	return nil
+}
+
+type CageCapacityRule struct{}
+
+func (CageCapacityRule) Name() string {
+	return "cage_capacity"
+}
+
+func (CageCapacityRule) Check(p Placement) *RuleViolation {
+	// the cage's own count stands in for occupants that were not read, less the dino when it is already inside
+	occupied := p.Cage.Occupancy
+	if p.From == p.Cage.Id {
+		occupied--
+	}
+	occupied = max(occupied, int64(len(p.Occupants)))
+	if occupied >= p.Cage.MaxCapacity {
+		return &RuleViolation{Code: CodeCapacityExceeded, Reason: fmt.Sprintf("The cage is full, it holds %d of %d dinosaurs", occupied, p.Cage.MaxCapacity)}
+	}
+	return nil
+}
+
+type DietSeparationRule struct{}
+
+func (DietSeparationRule) Name() string {
+	return "diet_separation"
+}
+
+func (DietSeparationRule) Check(p Placement) *RuleViolation {
+	diet := p.Species[p.Dino.Species].Diet
+	for _, occupant := range p.Occupants {
+		if p.Species[occupant.Species].Diet != diet && !p.Policy.Allows(p.Dino.Species, occupant.Species) {
+			return &RuleViolation{Code: CodeSpeciesConflict, Reason: fmt.Sprintf("A %s cannot share a cage with %s the %s", diet, occupant.Name, occupant.Species)}
+		}
+	}
+	return nil
+}
+
+type CarnivoreSpeciesRule struct{}
+
+func (CarnivoreSpeciesRule) Name() string {
+	return "carnivore_same_species"
+}
+
+func (CarnivoreSpeciesRule) Check(p Placement) *RuleViolation {
+	if p.Species[p.Dino.Species].Diet != DietCarnivore {
+		return nil
+	}
+	for _, occupant := range p.Occupants {
+		if p.Species[occupant.Species].Diet == DietCarnivore && occupant.Species != p.Dino.Species &&
+			!p.Policy.Allows(p.Dino.Species, occupant.Species) {
+			return &RuleViolation{Code: CodeSpeciesConflict, Reason: fmt.Sprintf("A %s can only share a cage with its own species, %s is a %s", p.Dino.Species, occupant.Name, occupant.Species)}
+		}
+	}
+	return nil
+}
+
+type PolicyGroupSizeRule struct{}
+
+func (PolicyGroupSizeRule) Name() string {
+	return "policy_group_size"
+}
+
+func (PolicyGroupSizeRule) Check(p Placement) *RuleViolation {
+	limit, ok := p.Policy.GroupLimit(p.Dino.Species)
+	if !ok {
+		return nil
+	}
+	group := 0
+	for _, occupant := range p.Occupants {
+		if occupant.Species == p.Dino.Species {
+			group++
+		}
+	}
+	if group >= limit {
+		return &RuleViolation{Code: CodeCapacityExceeded, Reason: fmt.Sprintf("The policy allows at most %d %s in a cage", limit, p.Dino.Species)}
+	}
+	return nil
+}
+
+type PolicyForbiddenPairRule struct{}
+
+func (PolicyForbiddenPairRule) Name() string {
+	return "policy_forbidden_pair"
+}
+
+func (PolicyForbiddenPairRule) Check(p Placement) *RuleViolation {
+	for _, occupant := range p.Occupants {
+		if p.Policy.Forbids(p.Dino.Species, occupant.Species) {
+			return &RuleViolation{Code: CodeSpeciesConflict, Reason: fmt.Sprintf("The policy forbids a %s sharing a cage with %s the %s", p.Dino.Species, occupant.Name, occupant.Species)}
+		}
+	}
+	return nil
+}
+
+// placementError lists every violated rule, nil when there are none.
+// Its code is the code of the first violated rule, the rules run most fundamental first.
+func placementError(violations []RuleViolation) error {
+	if len(violations) == 0 {
+		return nil
+	}
+	reasons := make([]string, 0, len(violations))
+	rules := make([]string, 0, len(violations))
+	for _, violation := range violations {
+		reasons = append(reasons, violation.Reason+".")
+		rules = append(rules, violation.Rule)
+	}
+	code := violations[0].Code
+	if code == "" {
+		code = CodePlacementRefused
+	}
+	return &ServiceRequestError{
+		err:        fmt.Sprintf("placement violates %s", strings.Join(rules, ", ")),
+		response:   "This dinosaur is not allowed to be put in this cage. " + strings.Join(reasons, " "),
+		code:       code,
+		violations: violations,
+	}
+}
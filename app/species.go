@@ -0,0 +1,200 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"jp/app/db"
+	"sync"
+)
+
+// speciesCache holds the species table by name. It is dropped whenever this service
+// changes a species, the generation stops a load that raced a change from being kept.
+type speciesCache struct {
+	mu         sync.Mutex
+	generation int64
+	species    map[string]Species
+}
+
+// load returns the cached species, reading them through repo when the cache is empty.
+// The returned map is shared and must not be modified.
+func (c *speciesCache) load(ctx context.Context, repo db.SpeciesRepository) (map[string]Species, error) {
+	c.mu.Lock()
+	if c.species != nil {
+		species := c.species
+		c.mu.Unlock()
+		return species, nil
+	}
+	generation := c.generation
+	c.mu.Unlock()
+
+	list, err := repo.List(ctx, db.SpeciesFilter{})
+	if err != nil {
+		return nil, err
+	}
+	species := make(map[string]Species, len(list))
+	for _, s := range list {
+		species[s.Name] = s
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generation == generation {
+		c.species = species
+	}
+	return species, nil
+}
+
+func (c *speciesCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.species = nil
+}
+
+// SpeciesCatalogue returns the species in the registry by name, the map is shared and must not be modified
+func (s dinoServiceImpl) SpeciesCatalogue(ctx context.Context) (map[string]Species, error) {
+	return s.species.load(ctx, s.dbService.Species())
+}
+
+// knownSpecies returns the species catalogue, failing when name is not in it
+func (s dinoServiceImpl) knownSpecies(ctx context.Context, name string) (map[string]Species, error) {
+	catalogue, err := s.species.load(ctx, s.dbService.Species())
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := catalogue[name]; !ok {
+		return nil, &ServiceRequestError{
+			err:      fmt.Sprintf("unknown species %s", name),
+			response: "Invalid entry for Species. ",
+			code:     CodeUnknownSpecies,
+		}
+	}
+	return catalogue, nil
+}
+
+// GetSpecies get a page of the species the park can hold
+func (s dinoServiceImpl) GetSpecies(ctx context.Context, page PageRequest) (Page[Species], error) {
+	afterId, err := validatePageRequest(page)
+	if err != nil {
+		return Page[Species]{}, err
+	}
+	species, err := s.dbService.Species().List(ctx, db.SpeciesFilter{AfterId: afterId, Limit: page.limit() + 1})
+	if err != nil {
+		return Page[Species]{}, err
+	}
+	return newPage(species, page.limit(), func(s Species) int64 { return s.Id }), nil
+}
+
+// GetSpeciesByName get a species by name
+func (s dinoServiceImpl) GetSpeciesByName(ctx context.Context, name string) (Species, error) {
+	return s.dbService.Species().GetByName(ctx, name)
+}
+
+// AddSpecies add a new species, returning it as stored
+func (s dinoServiceImpl) AddSpecies(ctx context.Context, species Species) (Species, error) {
+
+	v := newValidator()
+	err := v.Struct(species)
+	if err != nil {
+		return Species{}, validationFailed(err)
+	}
+
+	defer s.species.invalidate()
+	var created Species
+	err = s.dbService.InTx(ctx, func(repos db.Repositories) error {
+		err := repos.Species().Create(ctx, species)
+		if errors.Is(err, db.ErrDuplicate) {
+			return &ServiceRequestError{
+				err:      err.Error(),
+				response: fmt.Sprintf("The species %s already exists", species.Name),
+				code:     CodeConflict,
+			}
+		}
+		if err != nil {
+			return err
+		}
+		created, err = repos.Species().GetByName(ctx, species.Name)
+		if err != nil {
+			return err
+		}
+		return audit(ctx, repos, AuditCreate, AuditEntitySpecies, created.Id, nil, created)
+	})
+	if err != nil {
+		return Species{}, err
+	}
+	return created, nil
+}
+
+// UpdateSpecies changes the diet of a species, which is refused while dinos of that species are in the park.
+// The species is returned as stored.
+func (s dinoServiceImpl) UpdateSpecies(ctx context.Context, species Species) (Species, error) {
+
+	v := newValidator()
+	err := v.Struct(species)
+	if err != nil {
+		return Species{}, validationFailed(err)
+	}
+
+	defer s.species.invalidate()
+	var updated Species
+	err = s.dbService.InTx(ctx, func(repos db.Repositories) error {
+		current, err := repos.Species().GetByName(ctx, species.Name)
+		if err != nil {
+			return err
+		}
+
+		// changing the diet of housed dinos could break the rules in cages that already passed them
+		if current.Diet != species.Diet {
+			dinos, err := repos.Dinos().List(ctx, db.DinoFilter{Species: species.Name, Limit: 1})
+			if err != nil {
+				return err
+			}
+			if len(dinos) > 0 {
+				return &ServiceRequestError{
+					err:      fmt.Sprintf("species %s is in use", species.Name),
+					response: "There are dinosaurs of this species in the park, its diet cannot be changed",
+					code:     CodeSpeciesInUse,
+				}
+			}
+		}
+
+		err = repos.Species().Update(ctx, species)
+		if err != nil {
+			return err
+		}
+		updated, err = repos.Species().GetByName(ctx, species.Name)
+		if err != nil {
+			return err
+		}
+		return audit(ctx, repos, AuditUpdate, AuditEntitySpecies, current.Id, current, updated)
+	})
+	if err != nil {
+		return Species{}, err
+	}
+	return updated, nil
+}
+
+// DeleteSpecies removes a species no dinosaur has ever been recorded as
+func (s dinoServiceImpl) DeleteSpecies(ctx context.Context, name string) error {
+	defer s.species.invalidate()
+	return s.dbService.InTx(ctx, func(repos db.Repositories) error {
+		current, err := repos.Species().GetByName(ctx, name)
+		if err != nil {
+			return err
+		}
+
+		err = repos.Species().Delete(ctx, name)
+		if errors.Is(err, db.ErrReferenced) {
+			return &ServiceRequestError{
+				err:      err.Error(),
+				response: "There are dinosaurs recorded as this species, it cannot be deleted",
+				code:     CodeSpeciesInUse,
+			}
+		}
+		if err != nil {
+			return err
+		}
+		return audit(ctx, repos, AuditDelete, AuditEntitySpecies, current.Id, current, nil)
+	})
+}
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"jp/app"
 	"jp/app/db"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/rs/zerolog"
 )
 
@@ -22,18 +27,112 @@ func main() {
 
 	logger := zerolog.New(os.Stdout).With().Timestamp().Logger()
 
-	database, err := db.NewDbService(host, dbUser, dbPassword, dbName, dbPort)
-	if err != nil {
-		log.Fatalf("Could not set up database: %v", err)
+	// STORAGE=memory runs without postgres, starting from the seed data
+	var database db.DbService
+	if os.Getenv("STORAGE") == "memory" {
+		database = db.NewMemoryService()
+		log.Println("Using in-memory storage")
+	} else {
+		var err error
+		database, err = db.NewDbService(host, dbUser, dbPassword, dbName, dbPort)
+		if err != nil {
+			log.Fatalf("Could not set up database: %v", err)
+		}
 	}
-	defer database.GetConnection().Close()
+	defer database.Close()
 
 	dinoService := app.NewDinoService(database)
 
-	handler := app.NewHandler(dinoService, &logger)
+	// POLICY_FILE is the compatibility policy, it is read again on SIGHUP
+	if path := os.Getenv("POLICY_FILE"); path != "" {
+		policy, err := app.NewPolicyStore(context.Background(), path, dinoService)
+		if err != nil {
+			log.Fatalf("Could not load policy: %v", err)
+		}
+		log.Printf("Using policy file %s", path)
+		dinoService = dinoService.WithPolicy(policy)
+		go reloadPolicyOnHangup(policy, &logger)
+	}
+
+	// IDEMPOTENCY_TTL is how long the responses to requests sent with an Idempotency-Key are replayed, e.g. 12h
+	ttl := app.DefaultIdempotencyTTL
+	if value := os.Getenv("IDEMPOTENCY_TTL"); value != "" {
+		var err error
+		ttl, err = time.ParseDuration(value)
+		if err != nil || ttl <= 0 {
+			log.Fatalf("Invalid IDEMPOTENCY_TTL %q", value)
+		}
+	}
+	dinoService = dinoService.WithIdempotencyTTL(ttl)
+	go purgeIdempotentRequests(dinoService, ttl, &logger)
+
+	auth, err := authenticator()
+	if err != nil {
+		log.Fatalf("Could not set up authentication: %v", err)
+	}
+
+	// machine clients send an api key in X-API-Key instead of a bearer token
+	auth = app.NewAPIKeyAuthenticator(dinoService, auth)
+
+	handler := app.NewHandler(dinoService, dinoService, dinoService, &logger, auth)
 	err = http.ListenAndServe(addr, handler)
 	if err != nil {
 		log.Fatalf("Could start app: %v", err)
 	}
 
 }
+
+// authenticator checks bearer tokens with the keys from JWT_HS256_SECRET and the PEM file at JWT_RS256_PUBLIC_KEY_FILE.
+// AUTH_DISABLED=true lets every request through instead, for local runs only.
+func authenticator() (app.Authenticator, error) {
+	if os.Getenv("AUTH_DISABLED") == "true" {
+		log.Println("Authentication is disabled, every request is let through as an admin")
+		return app.OpenAccess{}, nil
+	}
+
+	config := app.JWTConfig{
+		HS256Secret: []byte(os.Getenv("JWT_HS256_SECRET")),
+		Issuer:      os.Getenv("JWT_ISSUER"),
+		Audience:    os.Getenv("JWT_AUDIENCE"),
+	}
+	if path := os.Getenv("JWT_RS256_PUBLIC_KEY_FILE"); path != "" {
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		config.RS256PublicKey, err = jwt.ParseRSAPublicKeyFromPEM(pem)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return app.NewJWTAuthenticator(config)
+}
+
+// purgeIdempotentRequests removes expired idempotent requests, checking as often as they expire
+// but at least hourly
+func purgeIdempotentRequests(store app.IdempotencyStore, ttl time.Duration, logger *zerolog.Logger) {
+	ticker := time.NewTicker(min(ttl, time.Hour))
+	defer ticker.Stop()
+	for range ticker.C {
+		purged, err := store.PurgeIdempotentRequests(context.Background())
+		if err != nil {
+			logger.Error().Err(err).Msg("idempotent request purge failed")
+			continue
+		}
+		logger.Debug().Int64("purged", purged).Msg("expired idempotent requests purged")
+	}
+}
+
+// reloadPolicyOnHangup reloads the policy on every SIGHUP, an invalid file leaves the policy in force
+func reloadPolicyOnHangup(policy *app.PolicyStore, logger *zerolog.Logger) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		err := policy.Reload(context.Background())
+		if err != nil {
+			logger.Error().Err(err).Msg("policy reload failed, keeping the current policy")
+			continue
+		}
+		logger.Info().Msg("policy reloaded")
+	}
+}
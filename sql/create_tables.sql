@@ -1,29 +1,123 @@
+CREATE TABLE IF NOT EXISTS species (
+    id BIGSERIAL PRIMARY KEY,
+    name text NOT NULL,
+    diet text NOT NULL CHECK (diet IN ('carnivore', 'herbivore')),
+    UNIQUE ("name")
+);
+
 CREATE TABLE IF NOT EXISTS dinosaur (
     id BIGSERIAL PRIMARY KEY,
     dino_name text NOT NULL,
     dino_species text NOT NULL,
-    cage_id bigint NOT NULL
+    cage_id bigint NOT NULL,
+    version bigint NOT NULL DEFAULT 1,
+    archived_at timestamptz
 );
 
 CREATE TABLE IF NOT EXISTS cage (
     id BIGSERIAL PRIMARY KEY,
     cage_name text NOT NULL,
     cage_status text NOT NULL,
+    max_capacity bigint NOT NULL CHECK (max_capacity > 0),
+    version bigint NOT NULL DEFAULT 1,
+    archived_at timestamptz,
     UNIQUE ("cage_name" )
 );
 
+-- every change to a dinosaur, cage or species, rows are only ever inserted
+CREATE TABLE IF NOT EXISTS audit_event (
+    id BIGSERIAL PRIMARY KEY,
+    actor text NOT NULL,
+    action text NOT NULL,
+    entity text NOT NULL,
+    entity_id bigint NOT NULL,
+    before jsonb,
+    after jsonb,
+    created_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS audit_event_entity ON audit_event (entity, entity_id, created_at);
+
+CREATE OR REPLACE FUNCTION audit_event_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_event is append only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_event_append_only BEFORE UPDATE OR DELETE ON audit_event
+    FOR EACH ROW EXECUTE FUNCTION audit_event_append_only();
+
+-- which cage each dino was in and when, removed_at is NULL while the dino is still there.
+-- There are no foreign keys so the history outlives deleted dinos and cages.
+CREATE TABLE IF NOT EXISTS dinosaur_placement (
+    id BIGSERIAL PRIMARY KEY,
+    dino_id bigint NOT NULL,
+    cage_id bigint NOT NULL,
+    placed_at timestamptz NOT NULL,
+    removed_at timestamptz
+);
+
+CREATE INDEX IF NOT EXISTS dinosaur_placement_dino ON dinosaur_placement (dino_id);
+CREATE INDEX IF NOT EXISTS dinosaur_placement_cage ON dinosaur_placement (cage_id, placed_at);
+
+-- credentials for machine clients, only the sha256 of each key is kept
+CREATE TABLE IF NOT EXISTS api_key (
+    id BIGSERIAL PRIMARY KEY,
+    name text NOT NULL,
+    prefix text NOT NULL,
+    key_hash text NOT NULL,
+    scopes text[] NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    last_used_at timestamptz,
+    revoked_at timestamptz,
+    UNIQUE ("key_hash")
+);
+
+-- the changes published on the event stream, rows are only ever inserted
+CREATE TABLE IF NOT EXISTS park_event (
+    id BIGSERIAL PRIMARY KEY,
+    type text NOT NULL,
+    data jsonb NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now()
+);
+
+-- the first response to each Idempotency-Key, status is 0 until the request has been answered
+CREATE TABLE IF NOT EXISTS idempotency_request (
+    subject text NOT NULL,
+    idempotency_key text NOT NULL,
+    fingerprint text NOT NULL,
+    status integer NOT NULL DEFAULT 0,
+    header jsonb,
+    body bytea,
+    expires_at timestamptz NOT NULL,
+    PRIMARY KEY (subject, idempotency_key)
+);
+CREATE INDEX IF NOT EXISTS idempotency_request_expires ON idempotency_request (expires_at);
+
 ALTER TABLE dinosaur ADD FOREIGN KEY ("cage_id") REFERENCES cage ("id");
+ALTER TABLE dinosaur ADD FOREIGN KEY ("dino_species") REFERENCES species ("name");
 
 
 -- seed data
+INSERT INTO species
+    (name, diet)
+VALUES
+    ('Tyrannosaurus', 'carnivore'),
+    ('Velociraptor', 'carnivore'),
+    ('Spinosaurus', 'carnivore'),
+    ('Megalosaurus', 'carnivore'),
+    ('Brachiosaurus', 'herbivore'),
+    ('Stegosaurus', 'herbivore'),
+    ('Ankylosaurus', 'herbivore'),
+    ('Triceratops', 'herbivore');
 INSERT INTO cage
-    (cage_name, cage_status)
+    (cage_name, cage_status, max_capacity)
 VALUES
-    ('Cage One', 'ACTIVE');
+    ('Cage One', 'ACTIVE', 4);
 INSERT INTO cage
-    (cage_name, cage_status)
+    (cage_name, cage_status, max_capacity)
 VALUES
-    ('Cage Two', 'ACTIVE');   
+    ('Cage Two', 'ACTIVE', 6);   
 INSERT INTO dinosaur
     (dino_name, dino_species, cage_id)
 VALUES
@@ -43,4 +137,9 @@ VALUES
 INSERT INTO dinosaur
     (dino_name, dino_species, cage_id)
 VALUES
-    ('Marge', 'Ankylosaurus', 2);    
\ No newline at end of file
+    ('Marge', 'Ankylosaurus', 2);
+
+-- the seed dinos start their history in the cage they were seeded in
+INSERT INTO dinosaur_placement
+    (dino_id, cage_id, placed_at)
+SELECT id, cage_id, now() FROM dinosaur;